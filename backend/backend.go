@@ -1,30 +1,136 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/lucacox/event-sourcing/registry"
 )
 
+const (
+	// AnyVersion disables the optimistic concurrency check in Save
+	AnyVersion uint64 = 0
+	// NoVersion makes Save succeed only if the entity has no events yet
+	NoVersion uint64 = math.MaxUint64
+)
+
+// ErrEmptyBatch is returned by Save when the batch holds no events
+var ErrEmptyBatch = errors.New("empty batch")
+
+// ErrMixedEntities is returned by Save when a batch holds events of different entities
+var ErrMixedEntities = errors.New("all events in a batch must belong to the same entity")
+
+// ErrDuplicateEvent is returned by Save when an event with the same Id was already
+// stored, e.g. by a retried Save whose first attempt succeeded. Nothing is stored
+var ErrDuplicateEvent = errors.New("duplicate event")
+
+// ErrInvalidEntityId is returned for entity ids that cannot be a subject token:
+// empty ids and ids holding '.', '*', '>' or whitespace
+var ErrInvalidEntityId = errors.New("invalid entity id")
+
+// Filter selects the events delivered by Subscribe, empty fields match any value
+type Filter struct {
+	EntityId  string
+	EventType string
+}
+
+func (f Filter) match(entityId string, eventType string) bool {
+	return (f.EntityId == "" || f.EntityId == entityId) && (f.EventType == "" || f.EventType == eventType)
+}
+
+// EventHandler is called by Subscribe for each event, an error stops the subscription
+type EventHandler func(*registry.Event) error
+
+// Backend is the storage of an EventStore. Every method that talks to the
+// storage has a Ctx variant honoring the given context cancellation and deadline,
+// the plain ones use a backend specific default timeout
 type Backend interface {
 	Connect() error
 	Close() error
 	SetEventRegistry(*registry.EventRegistry)
 	Setup(string, int) error
+	SetupCtx(context.Context, string, int) error
+	// saves a batch of events of a single entity, expecting the entity to be
+	// at the given version, and returns the new entity version. Saving is
+	// idempotent by event Id
 	Save([]*registry.Event, uint64) (uint64, error)
+	SaveCtx(context.Context, []*registry.Event, uint64) (uint64, error)
+	// returns the version of an entity: the stream sequence of its last event.
+	// Entity ids must be valid subject tokens, see ErrInvalidEntityId
+	Version(string) (uint64, error)
+	VersionCtx(context.Context, string) (uint64, error)
 	// returns all events in the store in a map of entity id to events
-	Load() (map[string]*registry.Event, error)
+	Load() (map[string][]*registry.Event, error)
+	LoadCtx(context.Context) (map[string][]*registry.Event, error)
 	// returns all events for a given entity id
 	LoadByEntityId(string) ([]*registry.Event, error)
+	LoadByEntityIdCtx(context.Context, string) ([]*registry.Event, error)
+	// returns the events for a given entity id starting from the given stream sequence
+	LoadByEntityIdFrom(string, uint64) ([]*registry.Event, error)
+	LoadByEntityIdFromCtx(context.Context, string, uint64) ([]*registry.Event, error)
 	// returns all events for a given event type
 	LoadByEventType(string) ([]*registry.Event, error)
+	LoadByEventTypeCtx(context.Context, string) ([]*registry.Event, error)
+	// returns, in stream order, all events with a given correlation id
+	LoadByCorrelationId(string) ([]*registry.Event, error)
+	LoadByCorrelationIdCtx(context.Context, string) ([]*registry.Event, error)
+	// delivers in order the events matching the filter, starting from the given
+	// stream sequence, then keeps delivering new ones as they are stored. It blocks
+	// until the context is done or the handler returns an error
+	Subscribe(context.Context, Filter, uint64, EventHandler) error
 }
 
 type ErrWrongSequence struct {
+	EntityId string
 	Expected uint64
 	Actual   uint64
 }
 
 func (e *ErrWrongSequence) Error() string {
-	return fmt.Sprintf("wrong sequence: expected %d, got %d", e.Expected, e.Actual)
+	expected := strconv.FormatUint(e.Expected, 10)
+	if e.Expected == NoVersion {
+		expected = "no version"
+	}
+	return fmt.Sprintf("wrong sequence for entity %s: expected %s, got %d", e.EntityId, expected, e.Actual)
+}
+
+// batchEntity returns the entity id shared by all the events of a batch
+func batchEntity(events []*registry.Event) (string, error) {
+	if len(events) == 0 {
+		return "", ErrEmptyBatch
+	}
+	id := events[0].EntityId
+	for _, event := range events[1:] {
+		if event.EntityId != id {
+			return "", ErrMixedEntities
+		}
+	}
+	return id, checkEntityId(id)
+}
+
+// checkEntityId verifies that id can be used as a subject token, so that the
+// subject filter of an entity cannot match the events of other entities. The
+// check is the same in every backend so that they accept the same ids
+func checkEntityId(id string) error {
+	if id == "" || strings.ContainsAny(id, ".*> \t\r\n") {
+		return fmt.Errorf("%w: %q", ErrInvalidEntityId, id)
+	}
+	return nil
+}
+
+// checkVersion verifies an entity current version against the expected one
+func checkVersion(entityId string, expected uint64, actual uint64) error {
+	switch {
+	case expected == AnyVersion:
+		return nil
+	case expected == NoVersion && actual == 0:
+		return nil
+	case expected == actual:
+		return nil
+	}
+	return &ErrWrongSequence{EntityId: entityId, Expected: expected, Actual: actual}
 }
@@ -0,0 +1,333 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lucacox/event-sourcing/keystore"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// memoryRecord is the in-memory equivalent of a stream message: the event
+// envelope and the serialized payload
+type memoryRecord struct {
+	sequence uint64
+	envelope *registry.Envelope
+	data     []byte
+}
+
+// DefaultDuplicateWindow is how long InMemoryBackend remembers the stored event
+// ids, the default duplicate window of the NATS streams
+const DefaultDuplicateWindow = 2 * time.Minute
+
+// storedId is an event id remembered for the duplicate window
+type storedId struct {
+	id       string
+	storedAt time.Time
+}
+
+// InMemoryBackend is a Backend that keeps all events in process memory.
+// Events are serialized with their codec on Save and decoded on Load, just
+// like a real store, so it can be used in tests and local demos in place of
+// NATSBackend. It is safe for concurrent use.
+type InMemoryBackend struct {
+	mu        sync.RWMutex
+	storeName string
+	er        *registry.EventRegistry
+	records   []*memoryRecord
+	versions  map[string]uint64
+	// ids indexes the event ids stored within the duplicate window to reject
+	// duplicates, expiry holds them in the order they were stored to expire them
+	ids    map[string]bool
+	expiry []storedId
+	window time.Duration
+	// notify is closed and replaced on every Save to wake up subscribers
+	notify chan struct{}
+}
+
+func NewInMemoryBackend() *InMemoryBackend {
+	return &InMemoryBackend{
+		versions: make(map[string]uint64),
+		ids:      make(map[string]bool),
+		window:   DefaultDuplicateWindow,
+		notify:   make(chan struct{}),
+	}
+}
+
+func (m *InMemoryBackend) Connect() error {
+	return nil
+}
+
+// Close is a no-op, stored events are kept until the backend is garbage collected
+func (m *InMemoryBackend) Close() error {
+	return nil
+}
+
+func (m *InMemoryBackend) SetEventRegistry(er *registry.EventRegistry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.er = er
+}
+
+// SetDuplicateWindow changes how long the stored event ids are remembered to
+// reject duplicates, DefaultDuplicateWindow by default
+func (m *InMemoryBackend) SetDuplicateWindow(window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.window = window
+}
+
+func (m *InMemoryBackend) Setup(storeName string, replicas int) error {
+	return m.SetupCtx(context.Background(), storeName, replicas)
+}
+
+func (m *InMemoryBackend) SetupCtx(ctx context.Context, storeName string, replicas int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeName = storeName
+	return nil
+}
+
+func (m *InMemoryBackend) Save(events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	return m.SaveCtx(context.Background(), events, expectedVersion)
+}
+
+func (m *InMemoryBackend) SaveCtx(ctx context.Context, events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	entityId, err := batchEntity(events)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// like JetStream, duplicates are checked first so that a retried Save
+	// is reported as such and not as a version conflict
+	now := time.Now()
+	m.expireIds(now)
+	batchIds := make(map[string]bool, len(events))
+	for _, event := range events {
+		if m.ids[event.Id] || batchIds[event.Id] {
+			return 0, ErrDuplicateEvent
+		}
+		batchIds[event.Id] = true
+	}
+
+	err = checkVersion(entityId, expectedVersion, m.versions[entityId])
+	if err != nil {
+		// a retry after the duplicate window fails the version check, look
+		// for the event among the newer ones like NATSBackend does
+		if m.stored(entityId, expectedVersion, events[0].Id) {
+			return 0, ErrDuplicateEvent
+		}
+		return 0, err
+	}
+
+	// serialize everything before touching the store so that a codec
+	// failure does not leave a partial write behind
+	last := m.lastSequence()
+	keys := keystore.WithKeyCache(ctx)
+	records := make([]*memoryRecord, 0, len(events))
+	for i, event := range events {
+		env, data, err := event.SerializePayloadCtx(keys)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, &memoryRecord{
+			sequence: last + uint64(i) + 1,
+			envelope: env,
+			data:     data,
+		})
+	}
+
+	for i, event := range events {
+		event.Sequence = records[i].sequence
+		m.ids[event.Id] = true
+		m.expiry = append(m.expiry, storedId{id: event.Id, storedAt: now})
+	}
+	m.records = append(m.records, records...)
+	m.versions[entityId] = m.lastSequence()
+	close(m.notify)
+	m.notify = make(chan struct{})
+
+	return m.versions[entityId], nil
+}
+
+func (m *InMemoryBackend) Version(id string) (uint64, error) {
+	return m.VersionCtx(context.Background(), id)
+}
+
+func (m *InMemoryBackend) VersionCtx(ctx context.Context, id string) (uint64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	err := checkEntityId(id)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.versions[id], nil
+}
+
+func (m *InMemoryBackend) Load() (map[string][]*registry.Event, error) {
+	return m.LoadCtx(context.Background())
+}
+
+func (m *InMemoryBackend) LoadCtx(ctx context.Context) (map[string][]*registry.Event, error) {
+	events, err := m.filter(ctx, func(r *memoryRecord) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]*registry.Event)
+	for _, event := range events {
+		result[event.EntityId] = append(result[event.EntityId], event)
+	}
+	return result, nil
+}
+
+func (m *InMemoryBackend) LoadByEntityId(id string) ([]*registry.Event, error) {
+	return m.LoadByEntityIdCtx(context.Background(), id)
+}
+
+func (m *InMemoryBackend) LoadByEntityIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	err := checkEntityId(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.filter(ctx, func(r *memoryRecord) bool { return r.envelope.EntityId == id })
+}
+
+func (m *InMemoryBackend) LoadByEntityIdFrom(id string, startSeq uint64) ([]*registry.Event, error) {
+	return m.LoadByEntityIdFromCtx(context.Background(), id, startSeq)
+}
+
+func (m *InMemoryBackend) LoadByEntityIdFromCtx(ctx context.Context, id string, startSeq uint64) ([]*registry.Event, error) {
+	err := checkEntityId(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.filter(ctx, func(r *memoryRecord) bool { return r.envelope.EntityId == id && r.sequence >= startSeq })
+}
+
+func (m *InMemoryBackend) LoadByEventType(evType string) ([]*registry.Event, error) {
+	return m.LoadByEventTypeCtx(context.Background(), evType)
+}
+
+func (m *InMemoryBackend) LoadByEventTypeCtx(ctx context.Context, evType string) ([]*registry.Event, error) {
+	return m.filter(ctx, func(r *memoryRecord) bool { return r.envelope.Type == evType })
+}
+
+func (m *InMemoryBackend) LoadByCorrelationId(id string) ([]*registry.Event, error) {
+	return m.LoadByCorrelationIdCtx(context.Background(), id)
+}
+
+func (m *InMemoryBackend) LoadByCorrelationIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	return m.filter(ctx, func(r *memoryRecord) bool { return r.envelope.Meta[registry.MetaCorrelationId] == id })
+}
+
+func (m *InMemoryBackend) Subscribe(ctx context.Context, filter Filter, fromSeq uint64, handler EventHandler) error {
+	if filter.EntityId != "" {
+		err := checkEntityId(filter.EntityId)
+		if err != nil {
+			return err
+		}
+	}
+	next := fromSeq
+	for {
+		// take the channel before reading so that a Save in between is not missed
+		m.mu.RLock()
+		notify := m.notify
+		m.mu.RUnlock()
+
+		events, err := m.filter(ctx, func(r *memoryRecord) bool {
+			return r.sequence >= next && filter.match(r.envelope.EntityId, r.envelope.Type)
+		})
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			err = handler(event)
+			if err != nil {
+				return err
+			}
+			next = event.Sequence + 1
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// expireIds forgets the event ids stored before the duplicate window, it must be
+// called with the lock held
+func (m *InMemoryBackend) expireIds(now time.Time) {
+	i := 0
+	for i < len(m.expiry) && now.Sub(m.expiry[i].storedAt) >= m.window {
+		delete(m.ids, m.expiry[i].id)
+		i++
+	}
+	m.expiry = m.expiry[i:]
+}
+
+// stored reports whether the event with the given id was stored on the entity
+// after version, it must be called with the lock held
+func (m *InMemoryBackend) stored(entityId string, version uint64, eventId string) bool {
+	if version == NoVersion {
+		version = 0
+	}
+	for _, r := range m.records {
+		if r.sequence > version && r.envelope.EntityId == entityId && r.envelope.Id == eventId {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSequence must be called with the lock held
+func (m *InMemoryBackend) lastSequence() uint64 {
+	if len(m.records) == 0 {
+		return 0
+	}
+	return m.records[len(m.records)-1].sequence
+}
+
+// filter decodes, in sequence order, all the records matching the given predicate,
+// reading the key of each entity once
+func (m *InMemoryBackend) filter(ctx context.Context, match func(*memoryRecord) bool) ([]*registry.Event, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	ctx = keystore.WithKeyCache(ctx)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []*registry.Event{}
+	for _, r := range m.records {
+		if !match(r) {
+			continue
+		}
+		event := m.er.NewEvent(r.envelope.Type)
+		if event == nil {
+			return nil, fmt.Errorf("unknown event type %q", r.envelope.Type)
+		}
+		err := event.DeserializePayloadCtx(ctx, r.envelope, r.data)
+		if err != nil {
+			return nil, err
+		}
+		event.Sequence = r.sequence
+		events = append(events, event)
+	}
+	return events, nil
+}
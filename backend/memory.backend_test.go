@@ -0,0 +1,427 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/keystore"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+type testPayload struct {
+	Value string `json:"value"`
+}
+
+func newTestRegistry() *registry.EventRegistry {
+	er := registry.NewEventRegistry()
+	codec := registry.NewJsonCodec(nil)
+	er.RegisterCodec(codec)
+	for _, name := range []string{"created", "updated"} {
+		evtType := name
+		er.Register(registry.NewEventType(evtType, codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      evtType,
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+				Payload:   testPayload{},
+			}
+		}))
+	}
+	return er
+}
+
+func newTestEvent(er *registry.EventRegistry, evtType string, entityId string, value string) *registry.Event {
+	evt := er.NewEvent(evtType)
+	evt.EntityId = entityId
+	evt.Payload = testPayload{Value: value}
+	return evt
+}
+
+func newTestMemoryBackend() (*InMemoryBackend, *registry.EventRegistry) {
+	er := newTestRegistry()
+	be := NewInMemoryBackend()
+	be.SetEventRegistry(er)
+	be.Connect()
+	be.Setup("test-store", 1)
+	return be, er
+}
+
+func TestInMemoryBackend_Save(t *testing.T) {
+	convey.Convey("Given an empty in-memory backend", t, func() {
+		be, er := newTestMemoryBackend()
+
+		convey.Convey("When saving a batch of events without expected sequence", func() {
+			events := []*registry.Event{
+				newTestEvent(er, "created", "e1", "a"),
+				newTestEvent(er, "updated", "e1", "b"),
+			}
+			seq, err := be.Save(events, 0)
+
+			convey.Convey("The events should be stored with increasing sequence numbers", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(2), seq, "Expected sequence number to be 2, but got %d", seq)
+				assert.Equal(t, uint64(1), events[0].Sequence)
+				assert.Equal(t, uint64(2), events[1].Sequence)
+			})
+		})
+
+		convey.Convey("When saving with the right expected sequence", func() {
+			seq, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+			seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, seq)
+
+			convey.Convey("The event should be stored", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(2), seq, "Expected sequence number to be 2, but got %d", seq)
+			})
+		})
+
+		convey.Convey("When saving with a stale expected version", func() {
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+			be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, 0)
+			seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, 1)
+
+			convey.Convey("A wrong sequence error should be returned and nothing stored", func() {
+				assert.Equal(t, uint64(0), seq)
+				assert.Equal(t, &ErrWrongSequence{EntityId: "e1", Expected: 1, Actual: 2}, err)
+				assert.EqualError(t, err, "wrong sequence for entity e1: expected 1, got 2")
+				events, _ := be.LoadByEntityId("e1")
+				assert.Len(t, events, 2, "Expected 2 events")
+			})
+		})
+
+		convey.Convey("When another entity is written in between", func() {
+			version, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, version)
+
+			convey.Convey("The entity version should still match", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(3), seq, "Expected version to be 3, but got %d", seq)
+				actual, _ := be.Version("e1")
+				assert.Equal(t, uint64(3), actual)
+				actual, _ = be.Version("e2")
+				assert.Equal(t, uint64(2), actual)
+			})
+		})
+
+		convey.Convey("When creating an entity that already exists", func() {
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+			_, err := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "b")}, NoVersion)
+
+			convey.Convey("A wrong sequence error should be returned", func() {
+				assert.Equal(t, &ErrWrongSequence{EntityId: "e1", Expected: NoVersion, Actual: 1}, err)
+				assert.EqualError(t, err, "wrong sequence for entity e1: expected no version, got 1")
+			})
+		})
+
+		convey.Convey("When saving a batch of different entities", func() {
+			_, err := be.Save([]*registry.Event{
+				newTestEvent(er, "created", "e1", "a"),
+				newTestEvent(er, "created", "e2", "b"),
+			}, 0)
+
+			convey.Convey("The batch should be rejected", func() {
+				assert.ErrorIs(t, err, ErrMixedEntities)
+			})
+		})
+
+		convey.Convey("When saving an empty batch", func() {
+			_, err := be.Save([]*registry.Event{}, AnyVersion)
+
+			convey.Convey("The batch should be rejected", func() {
+				assert.ErrorIs(t, err, ErrEmptyBatch)
+			})
+		})
+	})
+}
+
+func TestInMemoryBackend_Load(t *testing.T) {
+	convey.Convey("Given an in-memory backend with events for two entities", t, func() {
+		be, er := newTestMemoryBackend()
+		be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+		be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, 0)
+		be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, 0)
+
+		convey.Convey("LoadByEntityId should return the entity events in order", func() {
+			events, err := be.LoadByEntityId("e1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, events, 2, "Expected 2 events")
+			assert.Equal(t, "created", events[0].Type)
+			assert.Equal(t, "updated", events[1].Type)
+			assert.Equal(t, uint64(1), events[0].Sequence)
+			assert.Equal(t, uint64(3), events[1].Sequence)
+			assert.Equal(t, "e1", events[1].EntityId)
+			assert.Equal(t, testPayload{Value: "c"}, events[1].Payload)
+		})
+
+		convey.Convey("LoadByEntityIdFrom should skip the events before the start sequence", func() {
+			events, err := be.LoadByEntityIdFrom("e1", 2)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, events, 1, "Expected 1 event")
+			assert.Equal(t, uint64(3), events[0].Sequence)
+		})
+
+		convey.Convey("LoadByEventType should return the events of that type", func() {
+			events, err := be.LoadByEventType("created")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, events, 2, "Expected 2 events")
+			assert.Equal(t, "e1", events[0].EntityId)
+			assert.Equal(t, "e2", events[1].EntityId)
+		})
+
+		convey.Convey("Load should return the events of every entity", func() {
+			events, err := be.Load()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, events, 2, "Expected 2 entities")
+			assert.Len(t, events["e1"], 2, "Expected 2 events for e1")
+			assert.Len(t, events["e2"], 1, "Expected 1 event for e2")
+			assert.Equal(t, uint64(3), events["e1"][1].Sequence)
+			assert.Equal(t, uint64(2), events["e2"][0].Sequence)
+		})
+
+		convey.Convey("LoadByEntityId should return an empty list for an unknown entity", func() {
+			events, err := be.LoadByEntityId("unknown")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Empty(t, events, "Expected no events")
+		})
+	})
+}
+
+func TestInMemoryBackend_InvalidEntityId(t *testing.T) {
+	convey.Convey("Given an in-memory backend", t, func() {
+		be, er := newTestMemoryBackend()
+
+		convey.Convey("Ids that are not subject tokens should be rejected", func() {
+			for _, id := range []string{"", "e1.e2", "e*", "e>", "e 1"} {
+				_, err := be.Save([]*registry.Event{newTestEvent(er, "created", id, "a")}, AnyVersion)
+				assert.ErrorIs(t, err, ErrInvalidEntityId, "Expected id %q to be rejected", id)
+				_, err = be.Version(id)
+				assert.ErrorIs(t, err, ErrInvalidEntityId, "Expected id %q to be rejected", id)
+				_, err = be.LoadByEntityId(id)
+				assert.ErrorIs(t, err, ErrInvalidEntityId, "Expected id %q to be rejected", id)
+				_, err = be.LoadByEntityIdFrom(id, 1)
+				assert.ErrorIs(t, err, ErrInvalidEntityId, "Expected id %q to be rejected", id)
+			}
+		})
+
+		convey.Convey("Subscribing to an invalid id should fail", func() {
+			err := be.Subscribe(context.Background(), Filter{EntityId: "e1.>"}, 0, func(*registry.Event) error { return nil })
+			assert.ErrorIs(t, err, ErrInvalidEntityId)
+		})
+	})
+}
+
+// countingKeyStore counts the key reads
+type countingKeyStore struct {
+	*keystore.MemoryKeyStore
+	reads int
+}
+
+func (ks *countingKeyStore) GetKeyCtx(ctx context.Context, id string) ([]byte, error) {
+	ks.reads++
+	return ks.MemoryKeyStore.GetKeyCtx(ctx, id)
+}
+
+func TestInMemoryBackend_KeyCache(t *testing.T) {
+	convey.Convey("Given an in-memory backend encrypting the payloads", t, func() {
+		ks := &countingKeyStore{MemoryKeyStore: keystore.NewMemoryKeyStore()}
+		key, _ := keystore.GenerateKey()
+		ks.SetKey("e1", key)
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(ks)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("created", codec.Name(), func() *registry.Event {
+			return &registry.Event{Type: "created", Timestamp: time.Now(), Meta: map[string]string{}}
+		}))
+		be := NewInMemoryBackend()
+		be.SetEventRegistry(er)
+		be.Connect()
+		be.Setup("test-store", 1)
+
+		convey.Convey("The entity key should be read once per save and per load", func() {
+			events := []*registry.Event{}
+			for _, value := range []string{"a", "b", "c"} {
+				events = append(events, newTestEvent(er, "created", "e1", value))
+			}
+			_, err := be.Save(events, AnyVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, 1, ks.reads)
+
+			loaded, err := be.LoadByEntityId("e1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, loaded, 3, "Expected 3 events")
+			assert.Equal(t, 2, ks.reads)
+		})
+	})
+}
+
+func TestInMemoryBackend_Context(t *testing.T) {
+	convey.Convey("Given an in-memory backend and a cancelled context", t, func() {
+		be, er := newTestMemoryBackend()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		convey.Convey("Save should fail without storing anything", func() {
+			_, err := be.SaveCtx(ctx, []*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+			assert.ErrorIs(t, err, context.Canceled)
+			version, _ := be.Version("e1")
+			assert.Equal(t, uint64(0), version)
+		})
+
+		convey.Convey("Loads should fail", func() {
+			_, err := be.LoadByEntityIdCtx(ctx, "e1")
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = be.LoadCtx(ctx)
+			assert.ErrorIs(t, err, context.Canceled)
+		})
+	})
+}
+
+func TestInMemoryBackend_Concurrency(t *testing.T) {
+	convey.Convey("Given an in-memory backend", t, func() {
+		be, er := newTestMemoryBackend()
+
+		convey.Convey("When many writers save concurrently", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+					be.LoadByEntityId("e1")
+				}()
+			}
+			wg.Wait()
+
+			convey.Convey("Every event should be stored with a unique sequence", func() {
+				events, err := be.LoadByEntityId("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 50, "Expected 50 events")
+				for i, e := range events {
+					assert.Equal(t, uint64(i+1), e.Sequence)
+				}
+			})
+		})
+	})
+}
+
+func TestInMemoryBackend_Subscribe(t *testing.T) {
+	convey.Convey("Given an in-memory backend with stored events", t, func() {
+		be, er := newTestMemoryBackend()
+		be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, 0)
+		be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, 0)
+		be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, 0)
+
+		subscribe := func(filter Filter, fromSeq uint64, n int) ([]*registry.Event, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			received := []*registry.Event{}
+			err := be.Subscribe(ctx, filter, fromSeq, func(e *registry.Event) error {
+				received = append(received, e)
+				if len(received) == n {
+					cancel()
+				}
+				return nil
+			})
+			return received, err
+		}
+
+		convey.Convey("An entity subscription should replay only the entity events", func() {
+			events, err := subscribe(Filter{EntityId: "e1"}, 0, 2)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Len(t, events, 2, "Expected 2 events")
+			assert.Equal(t, uint64(1), events[0].Sequence)
+			assert.Equal(t, uint64(3), events[1].Sequence)
+		})
+
+		convey.Convey("An event type subscription should start from the given sequence", func() {
+			events, err := subscribe(Filter{EventType: "created"}, 2, 1)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Len(t, events, 1, "Expected 1 event")
+			assert.Equal(t, "e2", events[0].EntityId)
+		})
+
+		convey.Convey("A subscription should receive the events saved afterwards", func() {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				be.Save([]*registry.Event{newTestEvent(er, "updated", "e2", "d")}, 0)
+			}()
+			events, err := subscribe(Filter{}, 0, 4)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Len(t, events, 4, "Expected 4 events")
+			assert.Equal(t, testPayload{Value: "d"}, events[3].Payload)
+		})
+
+		convey.Convey("A handler error should stop the subscription", func() {
+			expectedErr := errors.New("handler failed")
+			err := be.Subscribe(context.Background(), Filter{}, 0, func(e *registry.Event) error {
+				return expectedErr
+			})
+			assert.ErrorIs(t, err, expectedErr)
+		})
+	})
+}
+
+func TestInMemoryBackend_Duplicates(t *testing.T) {
+	convey.Convey("Given an in-memory backend with a stored event", t, func() {
+		be, er := newTestMemoryBackend()
+		evt := newTestEvent(er, "created", "e1", "a")
+		version, _ := be.Save([]*registry.Event{evt}, NoVersion)
+
+		convey.Convey("Saving it again with the same expectation should be a duplicate", func() {
+			_, err := be.Save([]*registry.Event{evt}, NoVersion)
+			assert.ErrorIs(t, err, ErrDuplicateEvent)
+		})
+
+		convey.Convey("Saving it again without expectation should be a duplicate", func() {
+			_, err := be.Save([]*registry.Event{evt}, AnyVersion)
+			assert.ErrorIs(t, err, ErrDuplicateEvent)
+		})
+
+		convey.Convey("A batch holding it should be rejected as a whole", func() {
+			_, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b"), evt}, version)
+			assert.ErrorIs(t, err, ErrDuplicateEvent)
+			actual, _ := be.Version("e1")
+			assert.Equal(t, version, actual)
+		})
+
+		convey.Convey("A stale expectation should still be a wrong sequence", func() {
+			be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, version)
+			_, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, version)
+			var wrongSeq *ErrWrongSequence
+			assert.ErrorAs(t, err, &wrongSeq)
+			assert.NotErrorIs(t, err, ErrDuplicateEvent)
+		})
+	})
+
+	convey.Convey("Given an in-memory backend with a short duplicate window", t, func() {
+		be, er := newTestMemoryBackend()
+		be.SetDuplicateWindow(50 * time.Millisecond)
+		evt := newTestEvent(er, "created", "e1", "a")
+		be.Save([]*registry.Event{evt}, NoVersion)
+		time.Sleep(100 * time.Millisecond)
+
+		convey.Convey("The ids stored before the window should be forgotten", func() {
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			assert.Len(t, be.ids, 1, "Expected only the last id to be remembered")
+			assert.Len(t, be.expiry, 1, "Expected only the last id to be remembered")
+		})
+
+		convey.Convey("A retry with the same expectation should still be a duplicate", func() {
+			_, err := be.Save([]*registry.Event{evt}, NoVersion)
+			assert.ErrorIs(t, err, ErrDuplicateEvent)
+		})
+
+		convey.Convey("A retry without expectation should store the event again", func() {
+			seq, err := be.Save([]*registry.Event{evt}, AnyVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(2), seq)
+		})
+	})
+}
@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"context"
+
 	"github.com/lucacox/event-sourcing/registry"
 	"github.com/stretchr/testify/mock"
 )
@@ -28,14 +30,39 @@ func (m *MockBackend) Setup(name string, replicationFactor int) error {
 	return args.Error(0)
 }
 
+func (m *MockBackend) SetupCtx(ctx context.Context, name string, replicationFactor int) error {
+	args := m.Called(ctx, name, replicationFactor)
+	return args.Error(0)
+}
+
 func (m *MockBackend) Save(events []*registry.Event, expectedSeq uint64) (uint64, error) {
 	args := m.Called(events, expectedSeq)
 	return args.Get(0).(uint64), args.Error(1)
 }
 
-func (m *MockBackend) Load() (map[string]*registry.Event, error) {
+func (m *MockBackend) SaveCtx(ctx context.Context, events []*registry.Event, expectedSeq uint64) (uint64, error) {
+	args := m.Called(ctx, events, expectedSeq)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *MockBackend) Version(id string) (uint64, error) {
+	args := m.Called(id)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *MockBackend) VersionCtx(ctx context.Context, id string) (uint64, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *MockBackend) Load() (map[string][]*registry.Event, error) {
 	args := m.Called()
-	return args.Get(0).(map[string]*registry.Event), args.Error(1)
+	return args.Get(0).(map[string][]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) LoadCtx(ctx context.Context) (map[string][]*registry.Event, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(map[string][]*registry.Event), args.Error(1)
 }
 
 func (m *MockBackend) LoadByEntityId(id string) ([]*registry.Event, error) {
@@ -43,7 +70,42 @@ func (m *MockBackend) LoadByEntityId(id string) ([]*registry.Event, error) {
 	return args.Get(0).([]*registry.Event), args.Error(1)
 }
 
+func (m *MockBackend) LoadByEntityIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) LoadByEntityIdFrom(id string, startSeq uint64) ([]*registry.Event, error) {
+	args := m.Called(id, startSeq)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) LoadByEntityIdFromCtx(ctx context.Context, id string, startSeq uint64) ([]*registry.Event, error) {
+	args := m.Called(ctx, id, startSeq)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
 func (m *MockBackend) LoadByEventType(eventType string) ([]*registry.Event, error) {
 	args := m.Called(eventType)
 	return args.Get(0).([]*registry.Event), args.Error(1)
 }
+
+func (m *MockBackend) LoadByEventTypeCtx(ctx context.Context, eventType string) ([]*registry.Event, error) {
+	args := m.Called(ctx, eventType)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) LoadByCorrelationId(id string) ([]*registry.Event, error) {
+	args := m.Called(id)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) LoadByCorrelationIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]*registry.Event), args.Error(1)
+}
+
+func (m *MockBackend) Subscribe(ctx context.Context, filter Filter, fromSeq uint64, handler EventHandler) error {
+	args := m.Called(ctx, filter, fromSeq, handler)
+	return args.Error(0)
+}
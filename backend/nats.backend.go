@@ -2,10 +2,16 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/lucacox/event-sourcing/keystore"
 	"github.com/lucacox/event-sourcing/registry"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -15,6 +21,13 @@ type NATSBackendConfig struct {
 	Connection      string
 	Token           string
 	DefaultReplicas int
+	// DuplicateWindow is how long the stream remembers the event ids to reject
+	// duplicates, the server default (2 minutes) if zero
+	DuplicateWindow time.Duration
+	// BatchTimeout is how long a subscription waits for the commit of a batch
+	// saved with the commit protocol, holding back the events stored after it,
+	// before aborting the batch. 30 seconds if zero
+	BatchTimeout time.Duration
 }
 
 type NATSBackend struct {
@@ -26,6 +39,7 @@ type NATSBackend struct {
 	nc     *nats.Conn
 	js     jetstream.JetStream
 	stream jetstream.Stream
+	atomic bool
 }
 
 func NewNATSBackend(opt NATSBackendConfig) *NATSBackend {
@@ -64,119 +78,744 @@ func (n *NATSBackend) Close() error {
 	return nil
 }
 
+// defaultTimeout bounds the methods that do not take a context
+const defaultTimeout = 20 * time.Second
+
 func (n *NATSBackend) Setup(storeName string, replicas int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.SetupCtx(ctx, storeName, replicas)
+}
+
+func (n *NATSBackend) SetupCtx(ctx context.Context, storeName string, replicas int) error {
 	if replicas == 0 {
 		replicas = n.opts.DefaultReplicas
 	}
 	n.storeName = storeName
 	var err error
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
 
 	n.stream, err = n.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
-		Name:     storeName,
-		Subjects: []string{storeName + ".>"},
-		Replicas: replicas,
+		Name:       storeName,
+		Subjects:   []string{storeName + ".>"},
+		Replicas:   replicas,
+		Duplicates: n.opts.DuplicateWindow,
+		// servers older than 2.12 drop the setting, batches are then saved
+		// with the commit protocol
+		AllowAtomicPublish: true,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	n.atomic = n.stream.CachedInfo().Config.AllowAtomicPublish
+	return nil
+}
+
+const (
+	// expectedLastSubjSeqSubjectHeader narrows Nats-Expected-Last-Subject-Sequence
+	// to a (wildcard) subject other than the published one, requires nats-server 2.11+
+	expectedLastSubjSeqSubjectHeader = "Nats-Expected-Last-Subject-Sequence-Subject"
+
+	// atomic batch publish headers, requires nats-server 2.12+
+	batchIdHeader     = "Nats-Batch-Id"
+	batchSeqHeader    = "Nats-Batch-Sequence"
+	batchCommitHeader = "Nats-Batch-Commit"
+
+	// jsErrCodeAtomicPublishDuplicate is returned for atomic batches holding
+	// a message id already stored
+	jsErrCodeAtomicPublishDuplicate jetstream.ErrorCode = 10201
+)
+
+// the event envelope travels in the message headers and the body holds the
+// payload alone, so that events can be routed and filtered without decoding them
+const (
+	eventIdHeader        = "Event-Id"
+	eventTypeHeader      = "Event-Type"
+	entityIdHeader       = "Entity-Id"
+	eventTimestampHeader = "Event-Timestamp"
+	eventVersionHeader   = "Event-Version"
+	encryptedHeader      = "Event-Encrypted"
+	compressionHeader    = "Event-Compression"
+	codecHeader          = "Codec"
+	// metaHeaderPrefix prefixes the meta keys without a standard header
+	metaHeaderPrefix = "Meta-"
+)
+
+// metaHeaders maps the standard event metadata to the message headers
+var metaHeaders = map[string]string{
+	registry.MetaCorrelationId: "Correlation-Id",
+	registry.MetaCausationId:   "Causation-Id",
+	registry.MetaActor:         "Actor",
+	registry.MetaTenant:        "Tenant",
 }
 
-func (n *NATSBackend) Save(events []*registry.Event, expectedSequence uint64) (uint64, error) {
-	pubOpts := []jetstream.PublishOpt{
-		jetstream.WithExpectStream(n.storeName),
+// envelopeHeader returns the message headers carrying env
+func envelopeHeader(env *registry.Envelope) nats.Header {
+	header := nats.Header{}
+	header.Set(eventIdHeader, env.Id)
+	header.Set(eventTypeHeader, env.Type)
+	header.Set(entityIdHeader, env.EntityId)
+	header.Set(eventTimestampHeader, env.Timestamp.Format(time.RFC3339Nano))
+	header.Set(eventVersionHeader, strconv.Itoa(env.Version))
+	if env.Encrypted {
+		header.Set(encryptedHeader, "true")
+	}
+	if env.Compression != registry.NoCompression {
+		header.Set(compressionHeader, env.Compression.String())
+	}
+	header.Set(codecHeader, env.Codec)
+	for key, value := range env.Meta {
+		if name, ok := metaHeaders[key]; ok {
+			header.Set(name, headerValue(value))
+		} else {
+			header.Set(metaHeaderPrefix+headerKey(key), headerValue(value))
+		}
 	}
+	return header
+}
 
-	var ack *jetstream.PubAck
-	for i, event := range events {
-		subject := fmt.Sprintf("%s.%s.%s", n.storeName, event.EntityId, event.Type)
-		event.Meta["nats_subject"] = subject
+// headerKey encodes a meta key as a header name: the bytes that are not token
+// characters, and '%', are percent-encoded
+func headerKey(key string) string {
+	return escape(key, func(i int) bool {
+		c := key[i]
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&'*+-.^_`|~", c) >= 0
+	})
+}
 
-		if i == 0 && expectedSequence != 0 {
-			pubOpts = append(pubOpts, jetstream.WithExpectLastSequence(expectedSequence))
+// headerValue encodes a meta value as a header value: '%', the control bytes
+// and the leading and trailing spaces, that headers do not keep, are percent-encoded
+func headerValue(value string) string {
+	return escape(value, func(i int) bool {
+		c := value[i]
+		if c == ' ' {
+			return i > 0 && i < len(value)-1
 		}
+		return c >= 0x20 && c != 0x7f && c != '%'
+	})
+}
 
-		data, err := event.Serialize()
-		if err != nil {
-			return 0, err
+// escape percent-encodes the bytes of s not kept by keep, given their index
+func escape(s string, keep func(i int) bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if keep(i) {
+			b.WriteByte(s[i])
+		} else {
+			fmt.Fprintf(&b, "%%%02X", s[i])
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
-
-		// ack, err = n.js.Publish(ctx, subject, data, pubOpts...)
-		ack, err = n.js.PublishMsg(ctx, &nats.Msg{
-			Subject: subject,
-			Data:    data,
-			Header: nats.Header{
-				"Event-Type": []string{event.Type},
-				"Codec":      []string{event.Registry.GetType(event.Type).CodecName},
-			},
-		}, pubOpts...)
+	}
+	return b.String()
+}
+
+// headerEnvelope rebuilds the envelope carried by the message headers, it
+// returns nil for messages stored before the envelope moved to the headers
+func headerEnvelope(header nats.Header) (*registry.Envelope, error) {
+	if header.Get(eventIdHeader) == "" {
+		return nil, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, header.Get(eventTimestampHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", eventTimestampHeader, err)
+	}
+	version, err := strconv.Atoi(header.Get(eventVersionHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", eventVersionHeader, err)
+	}
+	compression := registry.NoCompression
+	if name := header.Get(compressionHeader); name != "" {
+		compression, err = registry.ParseCompression(name)
 		if err != nil {
-			if strings.Contains(err.Error(), "wrong last sequence") {
-				msg, _ := n.stream.GetLastMsgForSubject(ctx, subject)
-				return 0, &ErrWrongSequence{
-					Expected: expectedSequence,
-					Actual:   msg.Sequence,
-				}
+			return nil, fmt.Errorf("invalid %s header: %w", compressionHeader, err)
+		}
+	}
+	env := &registry.Envelope{
+		Id:          header.Get(eventIdHeader),
+		Type:        header.Get(eventTypeHeader),
+		EntityId:    header.Get(entityIdHeader),
+		Timestamp:   timestamp,
+		Version:     version,
+		Encrypted:   header.Get(encryptedHeader) == "true",
+		Compression: compression,
+		Codec:       header.Get(codecHeader),
+		Meta:        map[string]string{},
+	}
+	for key, name := range metaHeaders {
+		if values, ok := header[name]; ok {
+			env.Meta[key], err = url.PathUnescape(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s header: %w", name, err)
+			}
+		}
+	}
+	for name, values := range header {
+		if key, ok := strings.CutPrefix(name, metaHeaderPrefix); ok {
+			key, err = url.PathUnescape(key)
+			if err == nil {
+				env.Meta[key], err = url.PathUnescape(values[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s header: %w", name, err)
 			}
+		}
+	}
+	return env, nil
+}
+
+func (n *NATSBackend) Save(events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.SaveCtx(ctx, events, expectedVersion)
+}
+
+// SaveCtx stores all the events of the batch or none of them: a single event is
+// a plain publish, more events are sent as a JetStream atomic batch or, on servers
+// older than 2.12, with the commit protocol (see publishStaged)
+func (n *NATSBackend) SaveCtx(ctx context.Context, events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	entityId, err := batchEntity(events)
+	if err != nil {
+		return 0, err
+	}
+
+	// the events of a batch share the entity, so its key is read once
+	keys := keystore.WithKeyCache(ctx)
+	msgs := make([]*nats.Msg, 0, len(events))
+	for _, event := range events {
+		subject := fmt.Sprintf("%s.%s.%s", n.storeName, event.EntityId, event.Type)
+		event.Meta["nats_subject"] = subject
+
+		env, data, err := event.SerializePayloadCtx(keys)
+		if err != nil {
 			return 0, err
 		}
-		event.Meta["nats_stream_seq"] = fmt.Sprintf("%d", ack.Sequence)
+
+		header := envelopeHeader(env)
+		header.Set(jetstream.ExpectedStreamHeader, n.storeName)
+		msgs = append(msgs, &nats.Msg{Subject: subject, Data: data, Header: header})
+	}
+
+	version := expectedVersion
+	if version == NoVersion {
+		version = 0
 	}
-	return ack.Sequence, nil
+	seqs, err := n.publish(ctx, entityId, events, msgs, expectedVersion != AnyVersion, version)
+	var apiErr *jetstream.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
+		// the version is checked before the duplicate window, so a retried
+		// publish fails here: look for the event among the newer ones
+		if n.stored(ctx, entityId, expectedVersion, events[0].Id) {
+			return 0, ErrDuplicateEvent
+		}
+		committed, last, verr := n.versions(ctx, entityId)
+		if verr != nil {
+			return 0, verr
+		}
+		// the entity history may end with a batch that was never committed,
+		// readers skip it so the events go after it
+		if committed == version && last != committed {
+			seqs, err = n.publish(ctx, entityId, events, msgs, true, last)
+		}
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
+			actual, _ := n.VersionCtx(ctx, entityId)
+			return 0, &ErrWrongSequence{
+				EntityId: entityId,
+				Expected: expectedVersion,
+				Actual:   actual,
+			}
+		}
+	}
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode == jsErrCodeAtomicPublishDuplicate:
+		return 0, ErrDuplicateEvent
+	case err != nil:
+		return 0, err
+	}
+
+	for i, event := range events {
+		event.Sequence = seqs[i]
+		event.Meta["nats_stream_seq"] = fmt.Sprintf("%d", event.Sequence)
+	}
+	return seqs[len(seqs)-1], nil
 }
 
-func (n *NATSBackend) Load() (map[string]*registry.Event, error) {
-	return nil, nil
+// publish stores msgs, expecting the entity to be at version if check is set,
+// and returns the stream sequence of each message
+func (n *NATSBackend) publish(ctx context.Context, entityId string, events []*registry.Event, msgs []*nats.Msg, check bool, version uint64) ([]uint64, error) {
+	if len(msgs) > 1 && !n.atomic {
+		return n.publishStaged(ctx, entityId, events, msgs, check, version)
+	}
+
+	for i, msg := range msgs {
+		// the stream rejects the ids seen in its duplicate window
+		msg.Header.Set(jetstream.MsgIDHeader, events[i].Id)
+	}
+	// the version of an entity is the last sequence on <store>.<entity id>.>,
+	// the batch is checked as a whole so only the first message carries it
+	if check {
+		expectVersion(msgs[0], n.entitySubject(entityId), version)
+	}
+
+	var ack *jetstream.PubAck
+	var err error
+	if len(msgs) == 1 {
+		ack, err = n.js.PublishMsg(ctx, msgs[0])
+	} else {
+		ack, err = n.publishAtomic(ctx, msgs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ack.Duplicate {
+		return nil, ErrDuplicateEvent
+	}
+	// a committed batch is stored contiguously, the ack holds the last sequence
+	seqs := make([]uint64, len(msgs))
+	for i := range msgs {
+		seqs[i] = ack.Sequence - uint64(len(msgs)-1-i)
+	}
+	return seqs, nil
 }
 
-func (n *NATSBackend) LoadByEntityId(id string) ([]*registry.Event, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+// expectVersion makes the stream store msg only if the last message on subject
+// has the version sequence
+func expectVersion(msg *nats.Msg, subject string, version uint64) {
+	msg.Header.Set(jetstream.ExpectedLastSubjSeqHeader, strconv.FormatUint(version, 10))
+	msg.Header.Set(expectedLastSubjSeqSubjectHeader, subject)
+}
+
+// publishAtomic sends msgs as a JetStream atomic batch: the server stages
+// every message and stores them all when the last one, the commit, arrives
+func (n *NATSBackend) publishAtomic(ctx context.Context, msgs []*nats.Msg) (*jetstream.PubAck, error) {
+	batchId := uuid.New().String()
+	for i, msg := range msgs {
+		msg.Header.Set(batchIdHeader, batchId)
+		msg.Header.Set(batchSeqHeader, fmt.Sprintf("%d", i+1))
+		if i < len(msgs)-1 {
+			err := n.nc.PublishMsg(msg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg.Header.Set(batchCommitHeader, "1")
+	}
+
+	resp, err := n.nc.RequestMsgWithContext(ctx, msgs[len(msgs)-1])
+	if err != nil {
+		return nil, err
+	}
+	var ack struct {
+		jetstream.PubAck
+		Error *jetstream.APIError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(resp.Data, &ack)
+	if err != nil {
+		return nil, err
+	}
+	if ack.Error != nil {
+		return nil, ack.Error
+	}
+	return &ack.PubAck, nil
+}
+
+func (n *NATSBackend) Version(id string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancel()
+	return n.VersionCtx(ctx, id)
+}
 
-	subject := fmt.Sprintf("%s.%s.>", n.storeName, id)
+func (n *NATSBackend) VersionCtx(ctx context.Context, id string) (uint64, error) {
+	err := checkEntityId(id)
+	if err != nil {
+		return 0, err
+	}
+	version, _, err := n.versions(ctx, id)
+	return version, err
+}
 
-	c, err := n.stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
-		DeliverPolicy:  jetstream.DeliverAllPolicy,
-		FilterSubjects: []string{subject},
-	})
-	defer n.stream.DeleteConsumer(ctx, c.CachedInfo().Name)
+// entitySubject returns the subject filter matching all the events of an entity
+func (n *NATSBackend) entitySubject(id string) string {
+	return fmt.Sprintf("%s.%s.>", n.storeName, id)
+}
 
+func (n *NATSBackend) Load() (map[string][]*registry.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.LoadCtx(ctx)
+}
+
+func (n *NATSBackend) LoadCtx(ctx context.Context) (map[string][]*registry.Event, error) {
+	events, err := n.fetch(ctx, fmt.Sprintf("%s.>", n.storeName), 0, false)
 	if err != nil {
 		return nil, err
 	}
-	info, err := n.stream.Info(ctx)
+	result := make(map[string][]*registry.Event)
+	for _, event := range events {
+		result[event.EntityId] = append(result[event.EntityId], event)
+	}
+	return result, nil
+}
+
+func (n *NATSBackend) LoadByEntityId(id string) ([]*registry.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.LoadByEntityIdCtx(ctx, id)
+}
+
+func (n *NATSBackend) LoadByEntityIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	err := checkEntityId(id)
 	if err != nil {
 		return nil, err
 	}
-	num := info.State.Msgs
-	if num == 0 {
-		return []*registry.Event{}, nil
-	}
-	msgs, err := c.Fetch(int(num))
+	return n.fetch(ctx, n.entitySubject(id), 0, false)
+}
+
+func (n *NATSBackend) LoadByEntityIdFrom(id string, startSeq uint64) ([]*registry.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.LoadByEntityIdFromCtx(ctx, id, startSeq)
+}
+
+func (n *NATSBackend) LoadByEntityIdFromCtx(ctx context.Context, id string, startSeq uint64) ([]*registry.Event, error) {
+	err := checkEntityId(id)
 	if err != nil {
 		return nil, err
 	}
-	events := make([]*registry.Event, 0, num)
-	for msg := range msgs.Messages() {
-		etype := msg.Headers().Get("Event-Type")
-		codecName := msg.Headers().Get("Codec")
+	return n.fetch(ctx, n.entitySubject(id), startSeq, false)
+}
+
+func (n *NATSBackend) LoadByEventType(evType string) ([]*registry.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.LoadByEventTypeCtx(ctx, evType)
+}
+
+func (n *NATSBackend) LoadByEventTypeCtx(ctx context.Context, evType string) ([]*registry.Event, error) {
+	return n.fetch(ctx, fmt.Sprintf("%s.*.%s", n.storeName, evType), 0, true)
+}
 
-		event := n.er.NewEvent(etype)
-		err = n.er.GetCodec(codecName).Decode(msg.Data(), event)
+func (n *NATSBackend) LoadByCorrelationId(id string) ([]*registry.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return n.LoadByCorrelationIdCtx(ctx, id)
+}
+
+// LoadByCorrelationIdCtx scans the headers of the whole store, the correlation id
+// is not part of the subject, and reads and decodes only the matching messages.
+// Messages stored before the envelope moved to the headers are decoded to be checked
+func (n *NATSBackend) LoadByCorrelationIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	ctx = keystore.WithKeyCache(ctx)
+	msgs, err := n.fetchMsgs(ctx, fmt.Sprintf("%s.>", n.storeName), 0, true)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err = n.release(ctx, n.newBatchReader(false, 0), msgs)
+	if err != nil {
+		return nil, err
+	}
+	events := []*registry.Event{}
+	for _, msg := range msgs {
+		legacy := msg.header.Get(eventIdHeader) == ""
+		if !legacy && msg.header.Get(metaHeaders[registry.MetaCorrelationId]) != id {
+			continue
+		}
+		if msg.data == nil {
+			stored, err := n.stream.GetMsg(ctx, msg.sequence)
+			if err != nil {
+				return nil, err
+			}
+			msg = &storedMsg{subject: stored.Subject, header: stored.Header, data: stored.Data, sequence: stored.Sequence, timestamp: stored.Time}
+		}
+		event, err := n.decode(ctx, msg)
 		if err != nil {
 			return nil, err
 		}
-		md, err := msg.Metadata()
+		if legacy && event.Metadata().CorrelationId != id {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Subscribe is built on an ordered consumer, recreated by the client from the
+// last delivered message on failures. The subscription position is owned by the
+// caller through fromSeq, so no durable consumer is left on the server.
+// Events are delivered in stream order. Without atomic batch publish the events of
+// a batch, and the ones stored after it, are delivered when its commit is read: a
+// batch not committed within BatchTimeout is aborted, its writer failed. A filter
+// on the event type is then applied by the client, that has to see the whole batches
+func (n *NATSBackend) Subscribe(ctx context.Context, filter Filter, fromSeq uint64, handler EventHandler) error {
+	if filter.EntityId != "" {
+		err := checkEntityId(filter.EntityId)
+		if err != nil {
+			return err
+		}
+	}
+	subject := filter
+	byType := filter.EventType != ""
+	if byType && !n.atomic {
+		subject.EventType = ""
+		byType = false
+	}
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{n.filterSubject(subject)},
+	}
+	if fromSeq > 0 {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = fromSeq
+	}
+	c, err := n.stream.OrderedConsumer(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	msgs, err := c.Messages()
+	if err != nil {
+		return err
+	}
+	defer msgs.Stop()
+	stop := context.AfterFunc(ctx, msgs.Stop)
+	defer stop()
+
+	timeout := n.opts.BatchTimeout
+	if timeout == 0 {
+		timeout = defaultBatchTimeout
+	}
+	reader := n.newBatchReader(byType, fromSeq)
+	for {
+		for _, last := range reader.stale(timeout) {
+			err := n.abort(ctx, last)
+			if err != nil {
+				return err
+			}
+		}
+		msg, err := msgs.Next(jetstream.NextMaxWait(timeout))
+		switch {
+		case errors.Is(err, nats.ErrTimeout):
+			continue
+		case err != nil:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		sm, err := consumedMsg(msg)
+		if err != nil {
+			return err
+		}
+		released, err := reader.read(ctx, sm)
+		if err != nil {
+			return err
+		}
+		for _, sm := range released {
+			// keys are not cached, a subscription must see the entities
+			// forgotten while it runs
+			event, err := n.decode(ctx, sm)
+			if err != nil {
+				return err
+			}
+			if !filter.match(event.EntityId, event.Type) {
+				continue
+			}
+			err = handler(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// filterSubject returns the subject matching the events selected by filter
+func (n *NATSBackend) filterSubject(filter Filter) string {
+	entityId, eventType := "*", ">"
+	if filter.EntityId != "" {
+		entityId = filter.EntityId
+	}
+	if filter.EventType != "" {
+		eventType = filter.EventType
+	}
+	return fmt.Sprintf("%s.%s.%s", n.storeName, entityId, eventType)
+}
+
+// stored reports whether the event with the given id was stored on the entity
+// after version
+func (n *NATSBackend) stored(ctx context.Context, entityId string, version uint64, eventId string) bool {
+	if version == NoVersion {
+		version = 0
+	}
+	events, err := n.LoadByEntityIdFromCtx(ctx, entityId, version+1)
+	if err != nil {
+		return false
+	}
+	for _, event := range events {
+		if event.Id == eventId {
+			return true
+		}
+	}
+	return false
+}
+
+// storedMsg is a stream message, delivered by a consumer or read by sequence
+type storedMsg struct {
+	subject   string
+	header    nats.Header
+	data      []byte
+	sequence  uint64
+	timestamp time.Time
+}
+
+// consumedMsg returns the stored message delivered by a consumer
+func consumedMsg(msg jetstream.Msg) (*storedMsg, error) {
+	md, err := msg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	return &storedMsg{subject: msg.Subject(), header: msg.Headers(), data: msg.Data(), sequence: md.Sequence.Stream, timestamp: md.Timestamp}, nil
+}
+
+// entityId returns the entity of a message, its subject is <store>.<entity id>.<event type>
+func (sm *storedMsg) entityId() string {
+	tokens := strings.SplitN(sm.subject, ".", 3)
+	if len(tokens) < 2 {
+		return ""
+	}
+	return tokens[1]
+}
+
+// fetch reads, in stream order, all the events stored on subjects matching filter,
+// starting from the startSeq stream sequence if not zero. byType tells that the
+// filter selects an event type, so the other messages of the batches are not read.
+// The key of each entity is read once per fetch
+func (n *NATSBackend) fetch(ctx context.Context, filter string, startSeq uint64, byType bool) ([]*registry.Event, error) {
+	ctx = keystore.WithKeyCache(ctx)
+	msgs, err := n.fetchMsgs(ctx, filter, startSeq, false)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err = n.release(ctx, n.newBatchReader(byType, startSeq), msgs)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*registry.Event, 0, len(msgs))
+	for _, msg := range msgs {
+		event, err := n.decode(ctx, msg)
 		if err != nil {
 			return nil, err
 		}
-		event.Sequence = md.Sequence.Stream
 		events = append(events, event)
 	}
 	return events, nil
 }
 
-func (n *NATSBackend) LoadByEventType(evType string) ([]*registry.Event, error) {
-	return nil, nil
+// release reads msgs, up to the end of the stream, with reader and returns the
+// messages it releases. The batches still pending at the end are dropped
+func (n *NATSBackend) release(ctx context.Context, reader *batchReader, msgs []*storedMsg) ([]*storedMsg, error) {
+	released := make([]*storedMsg, 0, len(msgs))
+	for _, msg := range msgs {
+		out, err := reader.read(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, out...)
+	}
+	return append(released, reader.flush()...), nil
+}
+
+// fetchMsgs reads, in stream order, all the messages stored on subjects matching
+// filter, starting from the startSeq stream sequence if not zero. With headersOnly
+// the messages have no data
+func (n *NATSBackend) fetchMsgs(ctx context.Context, filter string, startSeq uint64, headersOnly bool) ([]*storedMsg, error) {
+	cfg := jetstream.ConsumerConfig{
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		AckPolicy:         jetstream.AckNonePolicy,
+		FilterSubjects:    []string{filter},
+		InactiveThreshold: time.Minute,
+		HeadersOnly:       headersOnly,
+	}
+	if startSeq > 0 {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = startSeq
+	}
+	c, err := n.stream.CreateConsumer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer n.stream.DeleteConsumer(ctx, c.CachedInfo().Name)
+
+	// the consumer is created before any delivery so the pending count is
+	// exactly the number of messages matching the filter
+	num := int(c.CachedInfo().NumPending)
+	stored := make([]*storedMsg, 0, num)
+	for len(stored) < num {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fetchOpts := []jetstream.FetchOpt{}
+		if deadline, ok := ctx.Deadline(); ok {
+			fetchOpts = append(fetchOpts, jetstream.FetchMaxWait(time.Until(deadline)))
+		}
+		msgs, err := c.Fetch(num-len(stored), fetchOpts...)
+		if err != nil {
+			return nil, err
+		}
+		for msg := range msgs.Messages() {
+			sm, err := consumedMsg(msg)
+			if err != nil {
+				return nil, err
+			}
+			if headersOnly {
+				sm.data = nil
+			}
+			stored = append(stored, sm)
+		}
+		if msgs.Error() != nil {
+			return nil, msgs.Error()
+		}
+	}
+	return stored, nil
+}
+
+// decode rebuilds an event from a stream message, reading the entity key with ctx
+func (n *NATSBackend) decode(ctx context.Context, msg *storedMsg) (*registry.Event, error) {
+	env, err := headerEnvelope(msg.header)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return n.decodeLegacy(msg)
+	}
+
+	event := n.er.NewEvent(env.Type)
+	if event == nil {
+		return nil, fmt.Errorf("unknown event type %q", env.Type)
+	}
+	err = event.DeserializePayloadCtx(ctx, env, msg.data)
+	if err != nil {
+		return nil, err
+	}
+	event.Sequence = msg.sequence
+	return event, nil
+}
+
+// decodeLegacy rebuilds an event stored with the whole event in the message body
+func (n *NATSBackend) decodeLegacy(msg *storedMsg) (*registry.Event, error) {
+	etype := msg.header.Get(eventTypeHeader)
+	// the codec header may carry parameters, such as the payload type
+	codecName, _ := registry.ParseCodecHeader(msg.header.Get(codecHeader))
+
+	event := n.er.NewEvent(etype)
+	if event == nil {
+		return nil, fmt.Errorf("unknown event type %q", etype)
+	}
+	codec := n.er.GetCodec(codecName)
+	if codec == nil {
+		return nil, fmt.Errorf("unknown codec %q", codecName)
+	}
+	// codecs need the entity id to find the payload key
+	event.EntityId = msg.entityId()
+	err := codec.Decode(msg.data, event)
+	if err != nil {
+		return nil, err
+	}
+	event.Sequence = msg.sequence
+	return event, nil
 }
@@ -0,0 +1,695 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/internal/natstest"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// newTestNATSBackend returns a backend on an embedded server, saving batches with
+// the commit protocol unless atomic is set
+func newTestNATSBackend(t *testing.T, atomic bool) (*NATSBackend, *registry.EventRegistry) {
+	er := newTestRegistry()
+	be := NewNATSBackend(NATSBackendConfig{Connection: natstest.RunServer(t)})
+	be.SetEventRegistry(er)
+	err := be.Connect()
+	if err != nil {
+		t.Fatalf("cannot connect to the NATS server: %v", err)
+	}
+	t.Cleanup(func() { be.Close() })
+	err = be.Setup("test-store", 1)
+	if err != nil {
+		t.Fatalf("cannot set up the stream: %v", err)
+	}
+	if !atomic {
+		be.atomic = false
+	}
+	return be, er
+}
+
+// stage stores evt as a message of a batch saved with the commit protocol, after
+// the previous message of its entity, committing the batch if commit is set
+func stage(t *testing.T, be *NATSBackend, evt *registry.Event, batchId string, base uint64, previous uint64, commit bool) uint64 {
+	env, data, err := evt.SerializePayload()
+	if err != nil {
+		t.Fatalf("cannot encode the event: %v", err)
+	}
+	msg := &nats.Msg{Subject: fmt.Sprintf("test-store.%s.%s", evt.EntityId, evt.Type), Header: envelopeHeader(env), Data: data}
+	msg.Header.Set(stagedBatchHeader, batchId)
+	msg.Header.Set(stagedBaseHeader, strconv.FormatUint(base, 10))
+	if commit {
+		msg.Header.Set(stagedCommitHeader, "1")
+	}
+	expectVersion(msg, be.entitySubject(evt.EntityId), previous)
+	ack, err := be.js.PublishMsg(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("cannot stage the event: %v", err)
+	}
+	return ack.Sequence
+}
+
+// subscribe collects the sequences of n events delivered by a subscription
+func subscribe(be Backend, filter Filter, fromSeq uint64, n int) ([]uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seqs := []uint64{}
+	err := be.Subscribe(ctx, filter, fromSeq, func(e *registry.Event) error {
+		seqs = append(seqs, e.Sequence)
+		if len(seqs) == n {
+			cancel()
+		}
+		return nil
+	})
+	return seqs, err
+}
+
+func TestEnvelopeHeader(t *testing.T) {
+	convey.Convey("Given an event envelope", t, func() {
+		env := &registry.Envelope{
+			Id:          "event-1",
+			Type:        "created",
+			EntityId:    "e1",
+			Timestamp:   time.Date(2024, 5, 1, 10, 0, 0, 123, time.UTC),
+			Version:     2,
+			Encrypted:   true,
+			Compression: registry.Zstd,
+			Codec:       "JSON Codec",
+			Meta:        map[string]string{registry.MetaCorrelationId: "c-1", "source": "api"},
+		}
+
+		convey.Convey("It should travel in the message headers", func() {
+			header := envelopeHeader(env)
+			assert.Equal(t, "event-1", header.Get("Event-Id"))
+			assert.Equal(t, "created", header.Get("Event-Type"))
+			assert.Equal(t, "e1", header.Get("Entity-Id"))
+			assert.Equal(t, "2024-05-01T10:00:00.000000123Z", header.Get("Event-Timestamp"))
+			assert.Equal(t, "2", header.Get("Event-Version"))
+			assert.Equal(t, "true", header.Get("Event-Encrypted"))
+			assert.Equal(t, "zstd", header.Get("Event-Compression"))
+			assert.Equal(t, "JSON Codec", header.Get("Codec"))
+			assert.Equal(t, "c-1", header.Get("Correlation-Id"))
+			assert.Equal(t, "api", header.Get("Meta-source"))
+
+			convey.Convey("And be rebuilt from them", func() {
+				decoded, err := headerEnvelope(header)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, env, decoded)
+			})
+		})
+
+		convey.Convey("Meta keys and values that headers cannot hold should be encoded", func() {
+			env.Meta = map[string]string{
+				"my key":                   "bob\r\nEntity-Id: zzz",
+				"ratio":                    "50%",
+				"padded":                   " x ",
+				registry.MetaActor:         "john: admin\n",
+				"Entity-Id":                "e2",
+				"ключ":                     "значение",
+				registry.MetaCorrelationId: "",
+			}
+			header := envelopeHeader(env)
+			assert.Equal(t, "bob%0D%0AEntity-Id: zzz", header.Get("Meta-my%20key"))
+			assert.Equal(t, "%20x%20", header.Get("Meta-padded"))
+			assert.Equal(t, "e1", header.Get("Entity-Id"))
+
+			decoded, err := headerEnvelope(header)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, env.Meta, decoded.Meta)
+		})
+
+		convey.Convey("Messages without envelope headers should give no envelope", func() {
+			decoded, err := headerEnvelope(nats.Header{"Event-Type": []string{"created"}})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Nil(t, decoded)
+		})
+	})
+}
+
+func TestBatchReader(t *testing.T) {
+	convey.Convey("Given the messages of batches saved with the commit protocol", t, func() {
+		seq := uint64(0)
+		msg := func(entityId string, batchId string, commit bool) *storedMsg {
+			seq++
+			header := nats.Header{}
+			if batchId != "" {
+				header.Set(stagedBatchHeader, batchId)
+				header.Set(stagedBaseHeader, "0")
+			}
+			if commit {
+				header.Set(stagedCommitHeader, "2")
+			}
+			return &storedMsg{subject: fmt.Sprintf("store.%s.created", entityId), header: header, sequence: seq}
+		}
+		abort := func(entityId string, batchId string) *storedMsg {
+			m := msg(entityId, batchId, false)
+			m.header.Set(stagedAbortHeader, "true")
+			return m
+		}
+		reader := (&NATSBackend{}).newBatchReader(false, 0)
+		read := func(msgs ...*storedMsg) []uint64 {
+			released := []uint64{}
+			for _, msg := range msgs {
+				out, err := reader.read(context.Background(), msg)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				for _, m := range out {
+					released = append(released, m.sequence)
+				}
+			}
+			return released
+		}
+
+		convey.Convey("A batch should be released in stream order when its commit is read", func() {
+			released := read(msg("e1", "b1", false), msg("e2", "", false), msg("e1", "b1", true))
+			assert.Equal(t, []uint64{1, 2, 3}, released)
+		})
+
+		convey.Convey("The messages after a pending batch should be held until it's committed", func() {
+			released := read(msg("e1", "", false), msg("e1", "b1", false), msg("e2", "", false), msg("e2", "", false))
+			assert.Equal(t, []uint64{1}, released)
+			released = read(msg("e1", "b1", true))
+			assert.Equal(t, []uint64{2, 3, 4, 5}, released)
+		})
+
+		convey.Convey("An aborted batch should be dropped, releasing the messages held after it", func() {
+			released := read(msg("e1", "b1", false), msg("e2", "", false), abort("e1", "b1"), msg("e2", "", false))
+			assert.Equal(t, []uint64{2, 4}, released)
+		})
+
+		convey.Convey("A stale batch holding messages back should be reported once", func() {
+			read(msg("e1", "b1", false), msg("e1", "b1", false))
+			assert.Empty(t, reader.stale(0))
+			read(msg("e2", "", false))
+			stale := reader.stale(0)
+			assert.Len(t, stale, 1)
+			assert.Equal(t, uint64(2), stale[0].sequence)
+			assert.Empty(t, reader.stale(0))
+		})
+
+		convey.Convey("The messages held at the end of the read should be flushed", func() {
+			released := read(msg("e1", "b1", false), msg("e2", "", false))
+			assert.Empty(t, released)
+			assert.Len(t, reader.flush(), 1)
+		})
+
+		convey.Convey("A batch never committed should be dropped by the next message of its entity", func() {
+			released := read(msg("e1", "b1", false), msg("e1", "b2", false), msg("e1", "b2", true), msg("e1", "", false))
+			assert.Equal(t, []uint64{2, 3, 4}, released)
+		})
+
+		convey.Convey("A batch still pending at the end of the read should not be released", func() {
+			released := read(msg("e1", "", false), msg("e1", "b1", false))
+			assert.Equal(t, []uint64{1}, released)
+		})
+	})
+}
+
+func TestNATSBackend_Subscribe(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		convey.Convey(fmt.Sprintf("Given a NATS backend with a batch of 3 events (atomic: %v)", atomic), t, func() {
+			be, er := newTestNATSBackend(t, atomic)
+			_, err := be.Save([]*registry.Event{
+				newTestEvent(er, "created", "e1", "a"),
+				newTestEvent(er, "updated", "e1", "b"),
+				newTestEvent(er, "updated", "e1", "c"),
+			}, NoVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			convey.Convey("A subscription from the middle of the batch should get only the rest of it", func() {
+				seqs, err := subscribe(be, Filter{}, 3, 1)
+				assert.ErrorIs(t, err, context.Canceled)
+				assert.Equal(t, []uint64{3}, seqs)
+				events, _ := be.LoadByEntityIdFrom("e1", 3)
+				assert.Len(t, events, 1)
+			})
+
+			convey.Convey("A subscription should get the events saved afterwards in order", func() {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "d")}, NoVersion)
+				}()
+				seqs, err := subscribe(be, Filter{}, 0, 4)
+				assert.ErrorIs(t, err, context.Canceled)
+				assert.Equal(t, []uint64{1, 2, 3, 4}, seqs)
+			})
+		})
+	}
+
+	convey.Convey("Given a NATS backend saving with the commit protocol", t, func() {
+		be, er := newTestNATSBackend(t, false)
+		be.opts.BatchTimeout = 100 * time.Millisecond
+
+		convey.Convey("The events stored while a batch is pending should be delivered after it", func() {
+			first := stage(t, be, newTestEvent(er, "created", "e1", "a"), "b1", 0, 0, false)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			stage(t, be, newTestEvent(er, "updated", "e1", "c"), "b1", 0, first, true)
+			seqs, err := subscribe(be, Filter{}, 0, 3)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Equal(t, []uint64{1, 2, 3}, seqs)
+
+			convey.Convey("And resuming after any of them should not lose the batch", func() {
+				for from := uint64(1); from <= 3; from++ {
+					seqs, err := subscribe(be, Filter{}, from, int(4-from))
+					assert.ErrorIs(t, err, context.Canceled)
+					assert.Equal(t, uint64(3), seqs[len(seqs)-1])
+				}
+			})
+		})
+
+		convey.Convey("A batch left pending by a failed writer should be aborted", func() {
+			stage(t, be, newTestEvent(er, "created", "e1", "a"), "b1", 0, 0, false)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			seqs, err := subscribe(be, Filter{}, 0, 1)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Equal(t, []uint64{2}, seqs)
+
+			msg, err := be.stream.GetLastMsgForSubject(context.Background(), be.entitySubject("e1"))
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, "true", msg.Header.Get(stagedAbortHeader))
+
+			convey.Convey("And the entity should accept new events", func() {
+				version, err := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "c")}, NoVersion)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				events, _ := be.LoadByEntityId("e1")
+				assert.Len(t, events, 1)
+				assert.Equal(t, version, events[0].Sequence)
+			})
+		})
+
+		convey.Convey("A commit after the abort should be rejected", func() {
+			first := stage(t, be, newTestEvent(er, "created", "e1", "a"), "b1", 0, 0, false)
+			last, _ := be.stream.GetMsg(context.Background(), first)
+			err := be.abort(context.Background(), &storedMsg{subject: last.Subject, header: last.Header, sequence: last.Sequence})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			msg := nats.NewMsg("test-store.e1.updated")
+			msg.Header.Set(stagedBatchHeader, "b1")
+			msg.Header.Set(stagedCommitHeader, "2")
+			expectVersion(msg, be.entitySubject("e1"), first)
+			_, err = be.js.PublishMsg(context.Background(), msg)
+			var apiErr *jetstream.APIError
+			assert.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, jetstream.JSErrCodeStreamWrongLastSequence, apiErr.ErrorCode)
+		})
+	})
+}
+
+func TestNATSBackend_Compression(t *testing.T) {
+	convey.Convey("Given a NATS backend with events stored uncompressed", t, func() {
+		be, er := newTestNATSBackend(t, true)
+		be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+
+		convey.Convey("Events compressed afterwards should load along with them", func() {
+			compressed := registry.NewEventRegistry()
+			codec := registry.NewCompressedCodec(registry.NewJsonCodec(nil), registry.Zstd, 64)
+			compressed.RegisterCodec(codec)
+			compressed.Register(registry.NewEventType("updated", codec.Name(), func() *registry.Event {
+				return &registry.Event{Type: "updated", Timestamp: time.Now(), Meta: map[string]string{}, Payload: testPayload{}}
+			}))
+			compressed.Register(er.GetType("created"))
+			be.SetEventRegistry(compressed)
+			large := strings.Repeat("interface eth0 up; ", 100)
+			_, err := be.Save([]*registry.Event{newTestEvent(compressed, "updated", "e1", large)}, AnyVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			msg, _ := be.stream.GetLastMsgForSubject(context.Background(), be.entitySubject("e1"))
+			assert.Equal(t, "zstd", msg.Header.Get(compressionHeader))
+			assert.Less(t, len(msg.Data), len(large))
+
+			events, err := be.LoadByEntityId("e1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, events, 2)
+			assert.Equal(t, testPayload{Value: "a"}, events[0].Payload)
+			assert.Equal(t, testPayload{Value: large}, events[1].Payload)
+		})
+	})
+}
+
+func TestNATSBackend_Meta(t *testing.T) {
+	convey.Convey("Given a NATS and an in-memory backend", t, func() {
+		be, er := newTestNATSBackend(t, true)
+		memory, _ := newTestMemoryBackend()
+		meta := map[string]string{
+			"my key":           "bob\r\nEntity-Id: zzz",
+			"ratio":            "50%",
+			"padded":           "\t x ",
+			registry.MetaActor: " john\n",
+		}
+
+		convey.Convey("Events should load back with the same meta from both", func() {
+			for _, b := range []Backend{be, memory} {
+				evt := newTestEvent(er, "created", "e1", "a")
+				for key, value := range meta {
+					evt.Meta[key] = value
+				}
+				_, err := b.Save([]*registry.Event{evt}, NoVersion)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+
+				events, err := b.LoadByEntityId("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 1)
+				assert.Equal(t, "e1", events[0].EntityId)
+				for key, value := range meta {
+					assert.Equal(t, value, events[0].Meta[key], "Expected meta %q to be kept", key)
+				}
+			}
+		})
+	})
+}
+
+func TestNATSBackend_Load(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		convey.Convey(fmt.Sprintf("Given a NATS backend with events for three entities (atomic: %v)", atomic), t, func() {
+			be, er := newTestNATSBackend(t, atomic)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			version, _ := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, AnyVersion)
+			batch := []*registry.Event{
+				newTestEvent(er, "created", "e3", "d"),
+				newTestEvent(er, "updated", "e3", "e"),
+			}
+			for _, evt := range batch {
+				evt.Meta[registry.MetaCorrelationId] = "request-1"
+			}
+			_, err := be.Save(batch, NoVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			// a batch of the commit protocol never committed by its writer
+			stage(t, be, newTestEvent(er, "updated", "e1", "x"), "b1", version, version, false)
+
+			convey.Convey("LoadByEntityId should return the entity events in order", func() {
+				events, err := be.LoadByEntityId("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 2, "Expected 2 events")
+				assert.Equal(t, "created", events[0].Type)
+				assert.Equal(t, "updated", events[1].Type)
+				assert.Equal(t, uint64(1), events[0].Sequence)
+				assert.Equal(t, uint64(3), events[1].Sequence)
+				assert.Equal(t, "e1", events[1].EntityId)
+				assert.Equal(t, testPayload{Value: "c"}, events[1].Payload)
+			})
+
+			convey.Convey("LoadByEntityIdFrom should skip the events before the start sequence", func() {
+				events, err := be.LoadByEntityIdFrom("e1", 2)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 1, "Expected 1 event")
+				assert.Equal(t, uint64(3), events[0].Sequence)
+			})
+
+			convey.Convey("LoadByEventType should return the events of that type", func() {
+				events, err := be.LoadByEventType("created")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 3, "Expected 3 events")
+				assert.Equal(t, "e1", events[0].EntityId)
+				assert.Equal(t, "e2", events[1].EntityId)
+				assert.Equal(t, "e3", events[2].EntityId)
+
+				events, err = be.LoadByEventType("updated")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 2, "Expected 2 events")
+				assert.Equal(t, uint64(3), events[0].Sequence)
+				assert.Equal(t, uint64(5), events[1].Sequence)
+			})
+
+			convey.Convey("Load should return the events of every entity", func() {
+				events, err := be.Load()
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 3, "Expected 3 entities")
+				assert.Len(t, events["e1"], 2, "Expected 2 events for e1")
+				assert.Len(t, events["e2"], 1, "Expected 1 event for e2")
+				assert.Len(t, events["e3"], 2, "Expected 2 events for e3")
+				assert.Equal(t, uint64(2), events["e2"][0].Sequence)
+				assert.Equal(t, testPayload{Value: "e"}, events["e3"][1].Payload)
+			})
+
+			convey.Convey("LoadByCorrelationId should return the events of the request", func() {
+				events, err := be.LoadByCorrelationId("request-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, events, 2, "Expected 2 events")
+				assert.Equal(t, uint64(4), events[0].Sequence)
+				assert.Equal(t, uint64(5), events[1].Sequence)
+			})
+
+			convey.Convey("LoadByEntityId should return an empty list for an unknown entity", func() {
+				events, err := be.LoadByEntityId("unknown")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Empty(t, events, "Expected no events")
+			})
+		})
+	}
+}
+
+func TestNATSBackend_Save(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		convey.Convey(fmt.Sprintf("Given an empty NATS backend (atomic: %v)", atomic), t, func() {
+			be, er := newTestNATSBackend(t, atomic)
+
+			convey.Convey("When saving with the right expected version", func() {
+				version, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+				seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, version)
+
+				convey.Convey("The event should be stored", func() {
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, uint64(2), seq, "Expected sequence number to be 2, but got %d", seq)
+					actual, _ := be.Version("e1")
+					assert.Equal(t, uint64(2), actual)
+				})
+			})
+
+			convey.Convey("When saving with a stale expected version", func() {
+				be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, AnyVersion)
+				be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, AnyVersion)
+				seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, 1)
+
+				convey.Convey("A wrong sequence error should be returned and nothing stored", func() {
+					assert.Equal(t, uint64(0), seq)
+					assert.Equal(t, &ErrWrongSequence{EntityId: "e1", Expected: 1, Actual: 2}, err)
+					events, _ := be.LoadByEntityId("e1")
+					assert.Len(t, events, 2, "Expected 2 events")
+				})
+			})
+
+			convey.Convey("When another entity is written in between", func() {
+				version, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+				be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+				seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, version)
+
+				convey.Convey("The entity version should still match", func() {
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, uint64(3), seq, "Expected version to be 3, but got %d", seq)
+					actual, _ := be.Version("e1")
+					assert.Equal(t, uint64(3), actual)
+					actual, _ = be.Version("e2")
+					assert.Equal(t, uint64(2), actual)
+					actual, _ = be.Version("unknown")
+					assert.Equal(t, uint64(0), actual)
+				})
+			})
+
+			convey.Convey("When creating an entity that already exists", func() {
+				be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+				_, err := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "b")}, NoVersion)
+
+				convey.Convey("A wrong sequence error should be returned", func() {
+					assert.Equal(t, &ErrWrongSequence{EntityId: "e1", Expected: NoVersion, Actual: 1}, err)
+				})
+			})
+
+			convey.Convey("When the entity history ends with a batch never committed", func() {
+				version, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+				stage(t, be, newTestEvent(er, "updated", "e1", "x"), "b1", version, version, false)
+
+				convey.Convey("The version should skip the batch and accept new events", func() {
+					actual, err := be.Version("e1")
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, version, actual)
+					seq, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, version)
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, uint64(3), seq)
+					events, _ := be.LoadByEntityId("e1")
+					assert.Len(t, events, 2, "Expected 2 events")
+				})
+			})
+		})
+	}
+}
+
+func TestNATSBackend_Batch(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		convey.Convey(fmt.Sprintf("Given a NATS backend with an entity (atomic: %v)", atomic), t, func() {
+			be, er := newTestNATSBackend(t, atomic)
+			version, _ := be.Save([]*registry.Event{newTestEvent(er, "created", "e1", "a")}, NoVersion)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			batch := func() []*registry.Event {
+				return []*registry.Event{
+					newTestEvent(er, "updated", "e1", "c"),
+					newTestEvent(er, "updated", "e1", "d"),
+					newTestEvent(er, "updated", "e1", "e"),
+				}
+			}
+
+			convey.Convey("When saving a batch with the right expected version", func() {
+				events := batch()
+				seq, err := be.Save(events, version)
+
+				convey.Convey("The events should be stored contiguously", func() {
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, uint64(5), seq)
+					assert.Equal(t, []uint64{3, 4, 5}, []uint64{events[0].Sequence, events[1].Sequence, events[2].Sequence})
+					actual, _ := be.Version("e1")
+					assert.Equal(t, uint64(5), actual)
+					loaded, _ := be.LoadByEntityId("e1")
+					assert.Len(t, loaded, 4, "Expected 4 events")
+				})
+
+				convey.Convey("Only the last message should carry the event id for the duplicate window", func() {
+					for i, evt := range events {
+						msg, err := be.stream.GetMsg(context.Background(), evt.Sequence)
+						assert.NoError(t, err, "Expected no error, but got %v", err)
+						if atomic {
+							assert.Equal(t, evt.Id, msg.Header.Get(jetstream.MsgIDHeader))
+							assert.Empty(t, msg.Header.Get(stagedBatchHeader))
+							continue
+						}
+						assert.NotEmpty(t, msg.Header.Get(stagedBatchHeader))
+						assert.Equal(t, strconv.FormatUint(version, 10), msg.Header.Get(stagedBaseHeader))
+						if i == len(events)-1 {
+							assert.Equal(t, evt.Id, msg.Header.Get(jetstream.MsgIDHeader))
+							assert.Equal(t, "3", msg.Header.Get(stagedCommitHeader))
+						} else {
+							assert.Empty(t, msg.Header.Get(jetstream.MsgIDHeader))
+							assert.Empty(t, msg.Header.Get(stagedCommitHeader))
+						}
+					}
+				})
+
+				convey.Convey("A subscription filtered by type should get the whole batch", func() {
+					seqs, err := subscribe(be, Filter{EventType: "updated"}, 0, 3)
+					assert.ErrorIs(t, err, context.Canceled)
+					assert.Equal(t, []uint64{3, 4, 5}, seqs)
+				})
+			})
+
+			convey.Convey("When saving a batch with a stale expected version", func() {
+				be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, version)
+				_, err := be.Save(batch(), version)
+
+				convey.Convey("A wrong sequence error should be returned and nothing stored", func() {
+					assert.Equal(t, &ErrWrongSequence{EntityId: "e1", Expected: version, Actual: 3}, err)
+					loaded, _ := be.LoadByEntityId("e1")
+					assert.Len(t, loaded, 2, "Expected 2 events")
+					actual, _ := be.Version("e1")
+					assert.Equal(t, uint64(3), actual)
+				})
+			})
+
+			convey.Convey("When saving a batch of different entities", func() {
+				_, err := be.Save([]*registry.Event{
+					newTestEvent(er, "updated", "e1", "c"),
+					newTestEvent(er, "updated", "e2", "d"),
+				}, AnyVersion)
+
+				convey.Convey("The batch should be rejected and nothing stored", func() {
+					assert.ErrorIs(t, err, ErrMixedEntities)
+					loaded, _ := be.Load()
+					assert.Len(t, loaded["e1"], 1, "Expected 1 event for e1")
+					assert.Len(t, loaded["e2"], 1, "Expected 1 event for e2")
+				})
+			})
+
+			convey.Convey("When a writer failed halfway through a batch of the commit protocol", func() {
+				stage(t, be, newTestEvent(er, "updated", "e1", "x"), "b1", version, version, false)
+				seq, err := be.Save(batch(), AnyVersion)
+
+				convey.Convey("The next batch should be stored after it and the failed one dropped", func() {
+					assert.NoError(t, err, "Expected no error, but got %v", err)
+					assert.Equal(t, uint64(6), seq)
+					loaded, _ := be.LoadByEntityId("e1")
+					assert.Len(t, loaded, 4, "Expected 4 events")
+					for _, evt := range loaded {
+						assert.NotEqual(t, testPayload{Value: "x"}, evt.Payload)
+					}
+					updated, _ := be.LoadByEventType("updated")
+					assert.Len(t, updated, 3, "Expected 3 events")
+				})
+			})
+		})
+	}
+
+	convey.Convey("Given a NATS backend saving with the commit protocol", t, func() {
+		be, er := newTestNATSBackend(t, false)
+
+		convey.Convey("A batch interleaved with the events of another entity should load in stream order", func() {
+			first := stage(t, be, newTestEvent(er, "created", "e1", "a"), "b1", 0, 0, false)
+			be.Save([]*registry.Event{newTestEvent(er, "created", "e2", "b")}, NoVersion)
+			stage(t, be, newTestEvent(er, "updated", "e1", "c"), "b1", 0, first, true)
+
+			loaded, err := be.Load()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Len(t, loaded["e1"], 2, "Expected 2 events for e1")
+			assert.Len(t, loaded["e2"], 1, "Expected 1 event for e2")
+			created, _ := be.LoadByEventType("created")
+			assert.Len(t, created, 2, "Expected 2 events")
+			assert.Equal(t, []uint64{1, 2}, []uint64{created[0].Sequence, created[1].Sequence})
+			actual, _ := be.Version("e1")
+			assert.Equal(t, uint64(3), actual)
+		})
+	})
+}
+
+func TestNATSBackend_Duplicates(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		convey.Convey(fmt.Sprintf("Given a NATS backend with a stored event (atomic: %v)", atomic), t, func() {
+			be, er := newTestNATSBackend(t, atomic)
+			evt := newTestEvent(er, "created", "e1", "a")
+			version, _ := be.Save([]*registry.Event{evt}, NoVersion)
+
+			convey.Convey("Saving it again with the same expectation should be a duplicate", func() {
+				_, err := be.Save([]*registry.Event{evt}, NoVersion)
+				assert.ErrorIs(t, err, ErrDuplicateEvent)
+			})
+
+			convey.Convey("Saving it again without expectation should be a duplicate", func() {
+				_, err := be.Save([]*registry.Event{evt}, AnyVersion)
+				assert.ErrorIs(t, err, ErrDuplicateEvent)
+			})
+
+			convey.Convey("A batch holding it should be rejected as a whole", func() {
+				_, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b"), evt}, version)
+				assert.ErrorIs(t, err, ErrDuplicateEvent)
+				actual, _ := be.Version("e1")
+				assert.Equal(t, version, actual)
+				events, _ := be.LoadByEntityId("e1")
+				assert.Len(t, events, 1, "Expected 1 event")
+			})
+
+			convey.Convey("A batch saved again should be a duplicate", func() {
+				batch := []*registry.Event{newTestEvent(er, "updated", "e1", "b"), newTestEvent(er, "updated", "e1", "c")}
+				_, err := be.Save(batch, version)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				_, err = be.Save(batch, version)
+				assert.ErrorIs(t, err, ErrDuplicateEvent)
+				_, err = be.Save(batch, AnyVersion)
+				assert.ErrorIs(t, err, ErrDuplicateEvent)
+				events, _ := be.LoadByEntityId("e1")
+				assert.Len(t, events, 3, "Expected 3 events")
+			})
+
+			convey.Convey("A stale expectation should still be a wrong sequence", func() {
+				be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "b")}, version)
+				_, err := be.Save([]*registry.Event{newTestEvent(er, "updated", "e1", "c")}, version)
+				var wrongSeq *ErrWrongSequence
+				assert.ErrorAs(t, err, &wrongSeq)
+				assert.NotErrorIs(t, err, ErrDuplicateEvent)
+			})
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucacox/event-sourcing/registry"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// commit protocol headers, used to save batches on servers without atomic batch
+// publish. Every message of the batch carries its id and the version of the
+// entity before the batch, the last message carries the commit too, or the abort
+// when a reader gave up waiting for it
+const (
+	stagedBatchHeader  = "Event-Batch-Id"
+	stagedBaseHeader   = "Event-Batch-Base"
+	stagedCommitHeader = "Event-Batch-Commit"
+	stagedAbortHeader  = "Event-Batch-Abort"
+)
+
+// defaultBatchTimeout is used when NATSBackendConfig.BatchTimeout is zero
+const defaultBatchTimeout = 30 * time.Second
+
+// staged reports whether a message belongs to a batch saved with the commit
+// protocol and is not its commit
+func staged(header nats.Header) bool {
+	return header.Get(stagedBatchHeader) != "" && header.Get(stagedCommitHeader) == ""
+}
+
+// publishStaged saves a batch with the commit protocol: the messages are published
+// one by one, each expecting the previous one to be the last of the entity, and the
+// last one commits the batch. The batch is therefore contiguous in the entity
+// history and readers hold back its events until they read the commit, dropping
+// them if another message of the entity comes first because the writer failed
+// halfway. Only the commit carries the event id for the duplicate window, so that
+// a retry after a failure does not stage a partial batch
+func (n *NATSBackend) publishStaged(ctx context.Context, entityId string, events []*registry.Event, msgs []*nats.Msg, check bool, version uint64) ([]uint64, error) {
+	subject := n.entitySubject(entityId)
+	for {
+		base := version
+		if !check {
+			_, last, err := n.versions(ctx, entityId)
+			if err != nil {
+				return nil, err
+			}
+			base = last
+		}
+
+		batchId := uuid.New().String()
+		seqs := make([]uint64, 0, len(msgs))
+		var err error
+		for i, msg := range msgs {
+			msg.Header.Set(stagedBatchHeader, batchId)
+			msg.Header.Set(stagedBaseHeader, strconv.FormatUint(base, 10))
+			msg.Header.Del(jetstream.MsgIDHeader)
+			if i == len(msgs)-1 {
+				msg.Header.Set(stagedCommitHeader, strconv.Itoa(len(msgs)))
+				msg.Header.Set(jetstream.MsgIDHeader, events[i].Id)
+			}
+			previous := base
+			if i > 0 {
+				previous = seqs[i-1]
+			}
+			expectVersion(msg, subject, previous)
+
+			var ack *jetstream.PubAck
+			ack, err = n.js.PublishMsg(ctx, msg)
+			if err != nil {
+				break
+			}
+			if ack.Duplicate {
+				// the batch was committed by an earlier attempt, the messages
+				// staged by this one are dropped by the readers
+				return nil, ErrDuplicateEvent
+			}
+			seqs = append(seqs, ack.Sequence)
+		}
+		var apiErr *jetstream.APIError
+		// without a version to check, a write of another process between the
+		// version lookup and the first message is not a conflict
+		if !check && len(seqs) == 0 && errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return seqs, nil
+	}
+}
+
+// versions returns the version of an entity, skipping the messages of the batches
+// never committed at the end of its history, along with the sequence of its last message
+func (n *NATSBackend) versions(ctx context.Context, id string) (uint64, uint64, error) {
+	msg, err := n.stream.GetLastMsgForSubject(ctx, n.entitySubject(id))
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	last := msg.Sequence
+	for staged(msg.Header) {
+		base, err := strconv.ParseUint(msg.Header.Get(stagedBaseHeader), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		if base == 0 {
+			return 0, last, nil
+		}
+		msg, err = n.stream.GetMsg(ctx, base)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return msg.Sequence, last, nil
+}
+
+// readBatch reads the messages of a batch of the entity, in order, starting from
+// the from stream sequence. It reports whether the batch was committed
+func (n *NATSBackend) readBatch(ctx context.Context, entityId string, batchId string, from uint64) ([]*storedMsg, bool, error) {
+	msgs := []*storedMsg{}
+	for seq := from; ; {
+		msg, err := n.stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(n.entitySubject(entityId)))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return msgs, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if msg.Header.Get(stagedBatchHeader) != batchId {
+			return msgs, false, nil
+		}
+		msgs = append(msgs, &storedMsg{subject: msg.Subject, header: msg.Header, data: msg.Data, sequence: msg.Sequence})
+		if msg.Header.Get(stagedCommitHeader) != "" {
+			return msgs, true, nil
+		}
+		seq = msg.Sequence + 1
+	}
+}
+
+// abort ends a batch left pending by a writer that failed, last being its last
+// message. The abort is stored only if it follows last in the entity history, so
+// the writer cannot commit the batch afterwards, and readers drop the batch when
+// they read it. A batch committed or followed in the meantime is left alone
+func (n *NATSBackend) abort(ctx context.Context, last *storedMsg) error {
+	msg := nats.NewMsg(last.subject)
+	msg.Header.Set(stagedBatchHeader, last.header.Get(stagedBatchHeader))
+	msg.Header.Set(stagedBaseHeader, last.header.Get(stagedBaseHeader))
+	msg.Header.Set(stagedAbortHeader, "true")
+	msg.Header.Set(jetstream.ExpectedStreamHeader, n.storeName)
+	expectVersion(msg, n.entitySubject(last.entityId()), last.sequence)
+	_, err := n.js.PublishMsg(ctx, msg)
+	var apiErr *jetstream.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
+		return nil
+	}
+	return err
+}
+
+// batchReader releases the messages read once it is known that they are not
+// part of a batch left uncommitted by the commit protocol. Messages are released
+// in stream order: the ones read after the first message of a pending batch are
+// held until the batch is committed or dropped
+type batchReader struct {
+	n *NATSBackend
+	// byType is set for reads filtered by event type, that do not see the
+	// other messages of a batch so they look for its commit in the stream
+	byType bool
+	// from is the first sequence read, the messages of a batch before it
+	// are not released
+	from uint64
+	// pending holds the messages of the batch being read, by entity
+	pending map[string][]*storedMsg
+	// held holds the messages ready to be released after a pending batch
+	held []*storedMsg
+	// committed caches whether a batch was committed, by batch id
+	committed map[string]bool
+	// aborted holds the ids of the batches returned by stale
+	aborted map[string]bool
+}
+
+func (n *NATSBackend) newBatchReader(byType bool, from uint64) *batchReader {
+	return &batchReader{
+		n:         n,
+		byType:    byType,
+		from:      from,
+		pending:   make(map[string][]*storedMsg),
+		committed: make(map[string]bool),
+		aborted:   make(map[string]bool),
+	}
+}
+
+// read takes the next message and returns the messages it releases, in stream
+// order: none while a batch is pending before them, the batch and the messages
+// held after it when msg commits or drops it
+func (r *batchReader) read(ctx context.Context, msg *storedMsg) ([]*storedMsg, error) {
+	batchId := msg.header.Get(stagedBatchHeader)
+	entityId := msg.entityId()
+	if r.byType {
+		if !staged(msg.header) {
+			return []*storedMsg{msg}, nil
+		}
+		committed, ok := r.committed[batchId]
+		if !ok {
+			var err error
+			_, committed, err = r.n.readBatch(ctx, entityId, batchId, msg.sequence+1)
+			if err != nil {
+				return nil, err
+			}
+			r.committed[batchId] = committed
+		}
+		if committed {
+			return []*storedMsg{msg}, nil
+		}
+		return nil, nil
+	}
+
+	pending := r.pending[entityId]
+	if len(pending) > 0 && pending[0].header.Get(stagedBatchHeader) != batchId {
+		// the writer of the pending batch failed before committing it
+		pending = nil
+	}
+	switch {
+	case batchId == "":
+		delete(r.pending, entityId)
+		return r.release(msg), nil
+	case msg.header.Get(stagedAbortHeader) != "":
+		delete(r.pending, entityId)
+		return r.release(), nil
+	case staged(msg.header):
+		r.pending[entityId] = append(pending, msg)
+		return r.release(), nil
+	}
+
+	delete(r.pending, entityId)
+	if len(pending) == 0 {
+		// the read started after the first messages of the batch
+		base, err := strconv.ParseUint(msg.header.Get(stagedBaseHeader), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		msgs, _, err := r.n.readBatch(ctx, entityId, batchId, base+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.sequence >= r.from {
+				pending = append(pending, m)
+			}
+		}
+		return r.release(pending...), nil
+	}
+	return r.release(append(pending, msg)...), nil
+}
+
+// release adds msgs to the held messages and returns, in stream order, the ones
+// before the first pending batch
+func (r *batchReader) release(msgs ...*storedMsg) []*storedMsg {
+	r.held = append(r.held, msgs...)
+	slices.SortFunc(r.held, func(a, b *storedMsg) int {
+		return cmp.Compare(a.sequence, b.sequence)
+	})
+	first := uint64(math.MaxUint64)
+	for _, pending := range r.pending {
+		first = min(first, pending[0].sequence)
+	}
+	i := 0
+	for i < len(r.held) && r.held[i].sequence < first {
+		i++
+	}
+	released := r.held[:i:i]
+	r.held = r.held[i:]
+	return released
+}
+
+// flush drops the pending batches and returns the messages held after them, for
+// reads that stop at the end of the stream
+func (r *batchReader) flush() []*storedMsg {
+	clear(r.pending)
+	return r.release()
+}
+
+// stale returns, once per batch, the last message of the pending batches that
+// hold messages back and were not continued for longer than timeout
+func (r *batchReader) stale(timeout time.Duration) []*storedMsg {
+	if len(r.held) == 0 {
+		return nil
+	}
+	msgs := []*storedMsg{}
+	for _, pending := range r.pending {
+		last := pending[len(pending)-1]
+		batchId := last.header.Get(stagedBatchHeader)
+		if r.aborted[batchId] || pending[0].sequence > r.held[0].sequence || time.Since(last.timestamp) <= timeout {
+			continue
+		}
+		r.aborted[batchId] = true
+		msgs = append(msgs, last)
+	}
+	return msgs
+}
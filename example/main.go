@@ -6,6 +6,7 @@ import (
 
 	"github.com/lucacox/event-sourcing/backend"
 	"github.com/lucacox/event-sourcing/keystore"
+	"github.com/lucacox/event-sourcing/projector"
 	"github.com/lucacox/event-sourcing/registry"
 	"github.com/lucacox/event-sourcing/store"
 )
@@ -26,43 +27,84 @@ type UpdateDeviceEventPayload struct {
 }
 
 type Device struct {
+	store.AggregateBase
+
 	DeviceId     string
 	Serial       string
 	MACAddresses []string
 	CreatedAt    time.Time
 	UpadatedAt   time.Time
+
+	router *projector.Router
 }
 
 func (d *Device) Id() string {
 	return d.DeviceId
 }
 
+// Project dispatches the events to the typed handlers below, redacted events
+// of forgotten devices have no payload and are skipped by the router
 func (d *Device) Project(e *registry.Event) error {
-	if e.Type == "new-device" {
-		payload := e.Payload.(map[string]interface{})
-		d.DeviceId = payload["device_id"].(string)
-		d.Serial = payload["serial"].(string)
-		macAddresses := payload["mac_addresses"].([]interface{})
-		d.MACAddresses = make([]string, len(macAddresses))
-		for i, addr := range macAddresses {
-			d.MACAddresses[i] = addr.(string)
-		}
-		d.CreatedAt, _ = time.Parse(time.RFC3339, payload["created_at"].(string))
-		d.UpadatedAt, _ = time.Parse(time.RFC3339, payload["updated_at"].(string))
+	if d.router == nil {
+		d.router = projector.NewRouter()
+		projector.OnTyped(d.router, "new-device", d.created)
+		projector.OnTyped(d.router, "update-device", d.updated)
 	}
+	return d.router.Project(e)
+}
 
-	if e.Type == "update-device" {
-		payload := e.Payload.(map[string]interface{})
-		d.DeviceId = payload["device_id"].(string)
-		d.Serial = payload["serial"].(string)
-		macAddresses := payload["mac_addresses"].([]interface{})
-		d.MACAddresses = make([]string, len(macAddresses))
-		for i, addr := range macAddresses {
-			d.MACAddresses[i] = addr.(string)
-		}
-		d.UpadatedAt, _ = time.Parse(time.RFC3339, payload["updated_at"].(string))
+// Register is the command creating the device, it does nothing if the device exists
+func (d *Device) Register(er *registry.EventRegistry, serial string, macs []string) error {
+	if d.Version() != 0 {
+		return nil
 	}
+	now := time.Now().Format(time.RFC3339)
+	evt, err := registry.NewTypedEvent(er, NewDeviceEventPayload{
+		DeviceId:     d.DeviceId,
+		Serial:       serial,
+		MACAddresses: macs,
+		CreatedAt:    now,
+		UpadatedAt:   now,
+	})
+	if err != nil {
+		return err
+	}
+	d.Record(evt)
+	return nil
+}
 
+// SetMACAddresses is the command updating the device MAC addresses
+func (d *Device) SetMACAddresses(er *registry.EventRegistry, macs []string) error {
+	if d.Version() == 0 {
+		return fmt.Errorf("device %s not registered", d.DeviceId)
+	}
+	evt, err := registry.NewTypedEvent(er, UpdateDeviceEventPayload{
+		DeviceId:     d.DeviceId,
+		Serial:       d.Serial,
+		MACAddresses: macs,
+		UpdatedAt:    time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	d.Record(evt)
+	return nil
+}
+
+func (d *Device) created(e *registry.Event, payload NewDeviceEventPayload) error {
+	d.DeviceId = payload.DeviceId
+	d.Serial = payload.Serial
+	d.MACAddresses = payload.MACAddresses
+	d.CreatedAt, _ = time.Parse(time.RFC3339, payload.CreatedAt)
+	d.UpadatedAt, _ = time.Parse(time.RFC3339, payload.UpadatedAt)
+	return nil
+}
+
+func (d *Device) updated(e *registry.Event, payload UpdateDeviceEventPayload) error {
+	d.DeviceId = payload.DeviceId
+	d.Serial = payload.Serial
+	d.MACAddresses = payload.MACAddresses
+	d.UpadatedAt, _ = time.Parse(time.RFC3339, payload.UpdatedAt)
 	return nil
 }
 
@@ -81,63 +123,38 @@ func main() {
 	defer es.Stop()
 
 	jsonCodec := registry.NewJsonCodec(ks)
-	er.RegisterCodec(jsonCodec)
-
-	newDeviceEventType := registry.NewEventType("new-device", jsonCodec.Name(), func() *registry.Event {
-		return &registry.Event{
-			Type:      "new-device",
-			Timestamp: time.Now(),
-			Meta:      map[string]string{},
-			Payload:   NewDeviceEventPayload{},
-		}
-	})
-	er.Register(newDeviceEventType)
-
-	updateDeviceEventType := registry.NewEventType("update-device", jsonCodec.Name(), func() *registry.Event {
-		return &registry.Event{
-			Type:      "update-device",
-			Timestamp: time.Now(),
-			Meta:      map[string]string{},
-			Payload:   UpdateDeviceEventPayload{},
-		}
-	})
-	er.Register(updateDeviceEventType)
-
-	evt := er.NewEvent("new-device")
-	evt.EntityId = "123"
-	evt.Payload = NewDeviceEventPayload{
-		DeviceId:     "123",
-		Serial:       "123456",
-		MACAddresses: []string{"00:00:00:00:00:00"},
-		CreatedAt:    "2020-01-01T00:00:00Z",
-		UpadatedAt:   "2020-01-01T00:00:00Z",
-	}
 
-	seq, err := es.AddEvent(evt, 0)
+	_, err = registry.RegisterTyped[NewDeviceEventPayload](er, "new-device", jsonCodec)
 	if err != nil {
 		panic(err)
 	}
-
-	evt1 := es.NewEvent("update-device")
-	evt1.EntityId = "123"
-	evt1.Payload = UpdateDeviceEventPayload{
-		DeviceId:     "123",
-		Serial:       "123456",
-		MACAddresses: []string{"00:00:00:00:00:00", "11:11:11:11:11:11"},
-		UpdatedAt:    time.Now().Format(time.RFC3339),
+	_, err = registry.RegisterTyped[UpdateDeviceEventPayload](er, "update-device", jsonCodec)
+	if err != nil {
+		panic(err)
 	}
 
-	_, err = es.AddEvent(evt1, seq)
+	// the repository loads the device, runs the command and saves the events it
+	// recorded, running it again if the device was changed in the meantime
+	devices := store.NewRepository(es, func(id string) *Device {
+		return &Device{DeviceId: id}
+	})
+	_, err = devices.Execute("123", func(d *Device) error {
+		return d.Register(er, "123456", []string{"00:00:00:00:00:00"})
+	})
 	if err != nil {
 		panic(err)
 	}
-
-	device := &Device{
-		DeviceId: "123",
+	_, err = devices.Execute("123", func(d *Device) error {
+		return d.SetMACAddresses(er, []string{"00:00:00:00:00:00", "11:11:11:11:11:11"})
+	})
+	if err != nil {
+		panic(err)
 	}
-	_, err = es.Project(device)
+
+	device, _, err := devices.Load("123")
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("Device: %+v\n", device)
+	fmt.Printf("Device: %s serial=%s macs=%v created=%s updated=%s\n",
+		device.DeviceId, device.Serial, device.MACAddresses, device.CreatedAt, device.UpadatedAt)
 }
@@ -0,0 +1,48 @@
+// Package kvbucket opens the JetStream Key-Value buckets of the NATS stores
+package kvbucket
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Bucket is a Key-Value bucket opened on first use, and created if it does not
+// exist. It is safe for concurrent use
+type Bucket struct {
+	js  jetstream.JetStream
+	cfg jetstream.KeyValueConfig
+
+	mu sync.Mutex
+	kv jetstream.KeyValue
+}
+
+// New returns the bucket configured by cfg, nothing is sent to the server until Get
+func New(js jetstream.JetStream, cfg jetstream.KeyValueConfig) *Bucket {
+	return &Bucket{js: js, cfg: cfg}
+}
+
+// Get returns the Key-Value bucket, creating it if it does not exist
+func (b *Bucket) Get(ctx context.Context) (jetstream.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.kv != nil {
+		return b.kv, nil
+	}
+
+	kv, err := b.js.KeyValue(ctx, b.cfg.Bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = b.js.CreateKeyValue(ctx, b.cfg)
+		// another process created it in the meantime
+		if errors.Is(err, jetstream.ErrBucketExists) {
+			kv, err = b.js.KeyValue(ctx, b.cfg.Bucket)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.kv = kv
+	return kv, nil
+}
@@ -0,0 +1,52 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type keyCacheCtxKey struct{}
+
+// keyCache holds the keys read during an operation, by entity id
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string]cachedKey
+}
+
+type cachedKey struct {
+	key []byte
+	err error
+}
+
+// WithKeyCache returns a context caching the keys read by CachedKey, so that an
+// operation on many events, such as loading an entity, reads each key once. The
+// cache lives as long as the context: keys deleted in the meantime are still
+// returned, so it must not outlive the operation
+func WithKeyCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keyCacheCtxKey{}, &keyCache{keys: make(map[string]cachedKey)})
+}
+
+// CachedKey returns the key of an entity from ks, through the cache of ctx if it
+// has one. Missing and deleted keys are cached too, other errors are not. The
+// cache is by entity id, so the codecs sharing it must share the KeyStore
+func CachedKey(ctx context.Context, ks KeyStore, id string) ([]byte, error) {
+	cache, ok := ctx.Value(keyCacheCtxKey{}).(*keyCache)
+	if !ok {
+		return ks.GetKeyCtx(ctx, id)
+	}
+	cache.mu.Lock()
+	cached, ok := cache.keys[id]
+	cache.mu.Unlock()
+	if ok {
+		return cached.key, cached.err
+	}
+
+	key, err := ks.GetKeyCtx(ctx, id)
+	if err == nil || errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyDeleted) {
+		cache.mu.Lock()
+		cache.keys[id] = cachedKey{key: key, err: err}
+		cache.mu.Unlock()
+	}
+	return key, err
+}
@@ -1,7 +1,36 @@
 package keystore
 
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrKeyNotFound is returned when an entity has no key in the store
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyDeleted is returned when the key of an entity was deleted
+var ErrKeyDeleted = errors.New("key deleted")
+
+// KeyStore holds the per-entity encryption keys. The Ctx variants honor the
+// given context cancellation and deadline. Deleting a key leaves a tombstone:
+// GetKey then returns ErrKeyDeleted instead of ErrKeyNotFound, so that the
+// codecs do not store the payloads of a forgotten entity in clear
 type KeyStore interface {
 	GetKey(string) ([]byte, error)
+	GetKeyCtx(context.Context, string) ([]byte, error)
 	SetKey(string, []byte) error
+	SetKeyCtx(context.Context, string, []byte) error
 	DeleteKey(string) error
+	DeleteKeyCtx(context.Context, string) error
+}
+
+// GenerateKey returns a new random AES-256 key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
@@ -1,8 +1,12 @@
 package keystore
 
-import "fmt"
+import (
+	"context"
+	"sync"
+)
 
 type MemoryKeyStore struct {
+	mu    sync.RWMutex
 	store map[string][]byte
 }
 
@@ -11,19 +15,50 @@ func NewMemoryKeyStore() *MemoryKeyStore {
 }
 
 func (mks *MemoryKeyStore) GetKey(id string) ([]byte, error) {
+	return mks.GetKeyCtx(context.Background(), id)
+}
+
+func (mks *MemoryKeyStore) GetKeyCtx(ctx context.Context, id string) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	mks.mu.RLock()
+	defer mks.mu.RUnlock()
 	key, ok := mks.store[id]
 	if !ok {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
+	}
+	if key == nil {
+		return nil, ErrKeyDeleted
 	}
 	return key, nil
 }
 
 func (mks *MemoryKeyStore) SetKey(id string, key []byte) error {
+	return mks.SetKeyCtx(context.Background(), id, key)
+}
+
+func (mks *MemoryKeyStore) SetKeyCtx(ctx context.Context, id string, key []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
 	mks.store[id] = key
 	return nil
 }
 
 func (mks *MemoryKeyStore) DeleteKey(id string) error {
-	delete(mks.store, id)
+	return mks.DeleteKeyCtx(context.Background(), id)
+}
+
+func (mks *MemoryKeyStore) DeleteKeyCtx(ctx context.Context, id string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
+	// a nil key is the tombstone
+	mks.store[id] = nil
 	return nil
 }
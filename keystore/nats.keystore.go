@@ -1,23 +1,118 @@
 package keystore
 
-import "github.com/nats-io/nats.go"
+import (
+	"context"
+	"errors"
+	"time"
 
+	"github.com/lucacox/event-sourcing/internal/kvbucket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// defaultTimeout bounds the methods that do not take a context
+const defaultTimeout = 20 * time.Second
+
+type NATSKeyStoreConfig struct {
+	// Bucket is the name of the Key-Value bucket, "encryption-keys" if empty
+	Bucket string
+	// Replicas of the bucket, 1 if zero
+	Replicas int
+	// History is the number of values kept for each key, 1 if zero
+	History uint8
+}
+
+// NATSKeyStore keeps the keys in a JetStream Key-Value bucket, created on first use.
+// Keys are stored by entity id, so entity ids must be valid NATS KV keys
 type NATSKeyStore struct {
-	nc *nats.Conn
+	opts   NATSKeyStoreConfig
+	js     jetstream.JetStream
+	bucket *kvbucket.Bucket
 }
 
-func NewNATSKeyStore(nc *nats.Conn) *NATSKeyStore {
-	return &NATSKeyStore{nc: nc}
+func NewNATSKeyStore(nc *nats.Conn, opt NATSKeyStoreConfig) (*NATSKeyStore, error) {
+	if opt.Bucket == "" {
+		opt.Bucket = "encryption-keys"
+	}
+	if opt.Replicas == 0 {
+		opt.Replicas = 1
+	}
+	if opt.History == 0 {
+		opt.History = 1
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	bucket := kvbucket.New(js, jetstream.KeyValueConfig{
+		Bucket:   opt.Bucket,
+		Replicas: opt.Replicas,
+		History:  opt.History,
+	})
+	return &NATSKeyStore{opts: opt, js: js, bucket: bucket}, nil
 }
 
 func (nks *NATSKeyStore) GetKey(id string) ([]byte, error) {
-	return nil, nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nks.GetKeyCtx(ctx, id)
+}
+
+func (nks *NATSKeyStore) GetKeyCtx(ctx context.Context, id string) ([]byte, error) {
+	kv, err := nks.bucket.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.Value()) == 0 {
+		return nil, ErrKeyDeleted
+	}
+	return entry.Value(), nil
 }
 
 func (nks *NATSKeyStore) SetKey(id string, value []byte) error {
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nks.SetKeyCtx(ctx, id, value)
+}
+
+func (nks *NATSKeyStore) SetKeyCtx(ctx context.Context, id string, value []byte) error {
+	kv, err := nks.bucket.Get(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, id, value)
+	return err
 }
 
 func (nks *NATSKeyStore) DeleteKey(id string) error {
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nks.DeleteKeyCtx(ctx, id)
+}
+
+// DeleteKeyCtx replaces the key with an empty value, the tombstone, then removes
+// all its past values from the bucket history, so that a deleted key cannot be
+// recovered. If the second step fails the key stays deleted, and calling
+// DeleteKeyCtx again purges the history
+func (nks *NATSKeyStore) DeleteKeyCtx(ctx context.Context, id string) error {
+	kv, err := nks.bucket.Get(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, id, []byte{})
+	if err != nil {
+		return err
+	}
+	stream, err := nks.js.Stream(ctx, "KV_"+nks.opts.Bucket)
+	if err != nil {
+		return err
+	}
+	return stream.Purge(ctx, jetstream.WithPurgeSubject("$KV."+nks.opts.Bucket+"."+id), jetstream.WithPurgeKeep(1))
 }
@@ -0,0 +1,80 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/internal/natstest"
+)
+
+func TestNATSKeyStore(t *testing.T) {
+	convey.Convey("Given a NATS key store on an embedded server", t, func() {
+		nc, err := nats.Connect(natstest.RunServer(t))
+		if err != nil {
+			t.Fatalf("cannot connect to the NATS server: %v", err)
+		}
+		t.Cleanup(nc.Close)
+		ks, err := NewNATSKeyStore(nc, NATSKeyStoreConfig{History: 5})
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+		key := bytes.Repeat([]byte{1}, 32)
+
+		convey.Convey("A key never stored should not be found", func() {
+			_, err := ks.GetKey("entity-1")
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		})
+
+		convey.Convey("When storing a key", func() {
+			err := ks.SetKey("entity-1", key)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			convey.Convey("It should be returned", func() {
+				stored, err := ks.GetKey("entity-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, key, stored)
+			})
+
+			convey.Convey("Another store on the same bucket should return it", func() {
+				other, _ := NewNATSKeyStore(nc, NATSKeyStoreConfig{})
+				stored, err := other.GetKey("entity-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, key, stored)
+			})
+
+			convey.Convey("Deleting it should leave a tombstone and purge its past values", func() {
+				ks.SetKey("entity-1", bytes.Repeat([]byte{2}, 32))
+				err := ks.DeleteKey("entity-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				_, err = ks.GetKey("entity-1")
+				assert.ErrorIs(t, err, ErrKeyDeleted)
+
+				kv, _ := ks.bucket.Get(context.Background())
+				history, err := kv.History(context.Background(), "entity-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, history, 1, "Expected only the tombstone in the history")
+				assert.Empty(t, history[0].Value())
+			})
+
+			convey.Convey("Deleting it should not touch the keys of other entities", func() {
+				ks.SetKey("entity-2", key)
+				ks.DeleteKey("entity-1")
+				stored, err := ks.GetKey("entity-2")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, key, stored)
+			})
+		})
+
+		convey.Convey("A cancelled context should fail the calls", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := ks.SetKeyCtx(ctx, "entity-1", key)
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = ks.GetKeyCtx(ctx, "entity-1")
+			assert.ErrorIs(t, err, context.Canceled)
+		})
+	})
+}
@@ -0,0 +1,13 @@
+package projector
+
+import "context"
+
+// CheckpointStore keeps the sequence of the last event processed by each projector,
+// a projector without checkpoint is at 0. The Ctx variants honor the given context
+// cancellation and deadline
+type CheckpointStore interface {
+	Get(string) (uint64, error)
+	GetCtx(context.Context, string) (uint64, error)
+	Set(string, uint64) error
+	SetCtx(context.Context, string, uint64) error
+}
@@ -0,0 +1,75 @@
+package projector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileCheckpointStore is a CheckpointStore keeping each checkpoint in a file named
+// after the projector in a directory, projector names must be valid file names
+type FileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore returns a FileCheckpointStore writing in dir, created if missing
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+func (f *FileCheckpointStore) Get(name string) (uint64, error) {
+	return f.GetCtx(context.Background(), name)
+}
+
+func (f *FileCheckpointStore) GetCtx(ctx context.Context, name string) (uint64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	data, err := os.ReadFile(f.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (f *FileCheckpointStore) Set(name string, seq uint64) error {
+	return f.SetCtx(context.Background(), name, seq)
+}
+
+// SetCtx writes the checkpoint to a temporary file renamed over the old one,
+// so that a crash never leaves a truncated checkpoint behind
+func (f *FileCheckpointStore) SetCtx(ctx context.Context, name string, seq uint64) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	tmp, err := os.CreateTemp(f.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.FormatUint(seq, 10))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(name))
+}
+
+func (f *FileCheckpointStore) path(name string) string {
+	return filepath.Join(f.dir, name+".checkpoint")
+}
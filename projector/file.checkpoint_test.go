@@ -0,0 +1,31 @@
+package projector
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	convey.Convey("Given a file checkpoint store", t, func() {
+		dir := t.TempDir()
+		cs, err := NewFileCheckpointStore(dir)
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+
+		convey.Convey("A missing checkpoint should be 0", func() {
+			seq, err := cs.Get("devices")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(0), seq)
+		})
+
+		convey.Convey("A checkpoint should survive a new store on the same directory", func() {
+			assert.NoError(t, cs.Set("devices", 41))
+			assert.NoError(t, cs.Set("devices", 42))
+			cs, _ := NewFileCheckpointStore(dir)
+			seq, err := cs.Get("devices")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(42), seq)
+		})
+	})
+}
@@ -0,0 +1,434 @@
+package projector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// ErrorPolicy tells a Manager what to do when a projector fails to project an event
+type ErrorPolicy int
+
+const (
+	// Halt stops the projector, its checkpoint stays before the failing event
+	Halt ErrorPolicy = iota
+	// Skip reports the error and moves on to the next event
+	Skip
+	// Retry projects the event again after Options.RetryDelay, up to
+	// Options.MaxRetries times (forever if zero), then halts
+	Retry
+)
+
+var (
+	ErrProjectorExists  = errors.New("projector already registered")
+	ErrUnknownProjector = errors.New("unknown projector")
+	ErrManagerStarted   = errors.New("manager already started")
+	ErrRebuildRunning   = errors.New("projector rebuild already running")
+
+	// errRebuildSwitched stops the rebuild feed once the projectors are switched
+	errRebuildSwitched = errors.New("rebuild switched")
+)
+
+// defaultRetryDelay is used when Options.RetryDelay is zero
+const defaultRetryDelay = time.Second
+
+// Source is the event feed of a Manager, it's implemented by store.EventStore.
+// Subscribe must deliver the events in stream order: the checkpoint of a projector
+// is the sequence of the last event projected, so it resumes right after it
+type Source interface {
+	Subscribe(ctx context.Context, filter backend.Filter, fromSeq uint64, handler backend.EventHandler) error
+}
+
+// Options of a projector run by a Manager
+type Options struct {
+	// Filter selects the events fed to the projector, all of them if empty
+	Filter backend.Filter
+	// OnError is the policy applied when Project fails, Halt by default
+	OnError ErrorPolicy
+	// MaxRetries bounds the Retry policy, zero retries forever
+	MaxRetries int
+	// RetryDelay is the wait before projecting an event again or resubscribing
+	// after a feed failure, 1 second if zero
+	RetryDelay time.Duration
+}
+
+func (o Options) retryDelay() time.Duration {
+	if o.RetryDelay == 0 {
+		return defaultRetryDelay
+	}
+	return o.RetryDelay
+}
+
+// ErrorHandler is notified of every error of a projector, evt is nil when the
+// error comes from the event feed or the checkpoint store
+type ErrorHandler func(name string, evt *registry.Event, err error)
+
+// Manager runs named projectors in the background, each one fed by the events of
+// a Source from its last checkpoint. Events are delivered at least once: the
+// checkpoint is saved after Project returns, so a crash in between projects the
+// event again on restart
+type Manager struct {
+	src     Source
+	cs      CheckpointStore
+	onError ErrorHandler
+
+	mu      sync.Mutex
+	workers map[string]*worker
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// worker state is guarded by Manager.mu, p is only changed while the worker
+// goroutine is not running
+type worker struct {
+	name string
+	p    Projector
+	opts Options
+	// err is the error that halted the worker
+	err error
+	// cancel and done stop and wait for the running worker goroutine
+	cancel context.CancelFunc
+	done   chan struct{}
+	// paused workers are not started by Start, rebuilding ones by Rebuild
+	paused     bool
+	rebuilding bool
+}
+
+// haltError marks the errors that stop a projector for good
+type haltError struct {
+	err error
+}
+
+func (h *haltError) Error() string {
+	return h.err.Error()
+}
+
+func (h *haltError) Unwrap() error {
+	return h.err
+}
+
+func NewManager(src Source, cs CheckpointStore) *Manager {
+	return &Manager{src: src, cs: cs, workers: make(map[string]*worker)}
+}
+
+// SetErrorHandler sets the function notified of the projectors errors
+func (m *Manager) SetErrorHandler(h ErrorHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onError = h
+}
+
+// Register adds a projector, started right away if the manager is running.
+// Project is called by a single goroutine, in the events order
+func (m *Manager) Register(name string, p Projector, opts Options) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.workers[name]; ok {
+		return ErrProjectorExists
+	}
+	w := &worker{name: name, p: p, opts: opts}
+	m.workers[name] = w
+	if m.ctx != nil {
+		m.launch(w)
+	}
+	return nil
+}
+
+// Start runs all the registered projectors until ctx is done or Stop is called
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx != nil {
+		return ErrManagerStarted
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	for _, w := range m.workers {
+		if w.paused {
+			continue
+		}
+		m.launch(w)
+	}
+	return nil
+}
+
+// Stop gracefully stops the projectors: the events being projected are completed
+// and checkpointed before it returns
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.ctx, m.cancel = nil, nil
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Err returns the error that halted a projector, nil if it's running
+func (m *Manager) Err(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.workers[name]
+	if !ok {
+		return ErrUnknownProjector
+	}
+	return w.err
+}
+
+// Projector returns the projector currently fed under name, the one to query
+// for the read model: it changes when a Rebuild completes
+func (m *Manager) Projector(name string) (Projector, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.workers[name]
+	if !ok {
+		return nil, ErrUnknownProjector
+	}
+	return w.p, nil
+}
+
+// Rebuild projects the whole event history, from sequence 1, into next while the
+// current projector keeps being fed and serving. Once next has caught up, the
+// current projector is paused, next gets the last events it's missing and then
+// replaces it, taking over its checkpoint. Events are never delivered to both
+// after the switch. Rebuild blocks until the switch or the first error, in which
+// case the current projector is resumed. It also restarts a halted projector.
+// When the manager is not running the switch happens right away and next is fed
+// the rest of the history by Start
+func (m *Manager) Rebuild(ctx context.Context, name string, next Projector) error {
+	m.mu.Lock()
+	w, ok := m.workers[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrUnknownProjector
+	}
+	if w.rebuilding {
+		m.mu.Unlock()
+		return ErrRebuildRunning
+	}
+	w.rebuilding = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		w.rebuilding = false
+		m.mu.Unlock()
+	}()
+
+	r := &rebuild{w: &worker{name: name, p: next, opts: w.opts}, changed: make(chan struct{}), done: make(chan struct{})}
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer close(r.done)
+		r.err = m.src.Subscribe(feedCtx, w.opts.Filter, 1, func(evt *registry.Event) error {
+			return r.project(feedCtx, m, evt)
+		})
+	}()
+
+	// catch up with the current projector while it's still running
+	target, err := m.cs.GetCtx(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = r.wait(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	// pause it and get the events it projected in the meantime
+	m.pause(w)
+	seq, err := m.cs.GetCtx(ctx, name)
+	if err == nil {
+		err = r.wait(ctx, seq)
+	}
+	if err == nil {
+		seq = r.stop()
+		cancel()
+		<-r.done
+		err = m.cs.SetCtx(ctx, name, seq)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		w.p = next
+	}
+	w.paused = false
+	if m.ctx != nil {
+		m.launch(w)
+	}
+	return err
+}
+
+// pause stops a worker, waiting for the event being projected to be checkpointed
+func (m *Manager) pause(w *worker) {
+	m.mu.Lock()
+	w.paused = true
+	cancel, done := w.cancel, w.done
+	running := m.ctx != nil && cancel != nil
+	m.mu.Unlock()
+	if running {
+		cancel()
+		<-done
+	}
+}
+
+// launch must be called with the lock held
+func (m *Manager) launch(w *worker) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	w.cancel, w.done = cancel, make(chan struct{})
+	w.err = nil
+	m.wg.Add(1)
+	go m.run(ctx, w, w.done)
+}
+
+// run follows the event feed, subscribing again from the checkpoint after a
+// feed failure, until ctx is done or the projector halts
+func (m *Manager) run(ctx context.Context, w *worker, done chan struct{}) {
+	defer m.wg.Done()
+	defer close(done)
+	for {
+		err := m.follow(ctx, w)
+		if ctx.Err() != nil {
+			return
+		}
+		var halt *haltError
+		if errors.As(err, &halt) {
+			m.mu.Lock()
+			w.err = halt.err
+			m.mu.Unlock()
+			return
+		}
+		m.report(w.name, nil, err)
+		if !sleep(ctx, w.opts.retryDelay()) {
+			return
+		}
+	}
+}
+
+func (m *Manager) follow(ctx context.Context, w *worker) error {
+	seq, err := m.cs.GetCtx(ctx, w.name)
+	if err != nil {
+		return err
+	}
+	return m.src.Subscribe(ctx, w.opts.Filter, seq+1, func(evt *registry.Event) error {
+		err := m.project(ctx, w, evt)
+		if err != nil {
+			return err
+		}
+		// not bound to ctx, so that the event being projected while stopping
+		// is checkpointed too
+		return m.cs.Set(w.name, evt.Sequence)
+	})
+}
+
+// project applies an event to the projector following its error policy
+func (m *Manager) project(ctx context.Context, w *worker, evt *registry.Event) error {
+	for attempt := 0; ; attempt++ {
+		err := w.p.Project(evt)
+		if err == nil {
+			return nil
+		}
+		m.report(w.name, evt, err)
+		switch w.opts.OnError {
+		case Skip:
+			return nil
+		case Retry:
+			if w.opts.MaxRetries > 0 && attempt >= w.opts.MaxRetries {
+				return &haltError{err}
+			}
+			if !sleep(ctx, w.opts.retryDelay()) {
+				return ctx.Err()
+			}
+		default:
+			return &haltError{err}
+		}
+	}
+}
+
+// rebuild is the feed of the projector being rebuilt by Manager.Rebuild
+type rebuild struct {
+	w *worker
+
+	// mu is held while projecting, so that stop never interrupts an event
+	mu      sync.Mutex
+	seq     uint64
+	stopped bool
+	// changed is closed and replaced every time seq changes
+	changed chan struct{}
+
+	// done is closed when the feed is over, err is its result
+	done chan struct{}
+	err  error
+}
+
+func (r *rebuild) project(ctx context.Context, m *Manager, evt *registry.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return errRebuildSwitched
+	}
+	err := m.project(ctx, r.w, evt)
+	if err != nil {
+		return err
+	}
+	r.seq = evt.Sequence
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return nil
+}
+
+// wait blocks until the rebuilt projector reaches seq
+func (r *rebuild) wait(ctx context.Context, seq uint64) error {
+	for {
+		r.mu.Lock()
+		current, changed := r.seq, r.changed
+		r.mu.Unlock()
+		if current >= seq {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			var halt *haltError
+			if errors.As(r.err, &halt) {
+				return halt.err
+			}
+			return r.err
+		case <-changed:
+		}
+	}
+}
+
+// stop prevents the feed from projecting more events and returns the last one
+func (r *rebuild) stop() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	return r.seq
+}
+
+func (m *Manager) report(name string, evt *registry.Event, err error) {
+	m.mu.Lock()
+	onError := m.onError
+	m.mu.Unlock()
+	if onError != nil {
+		onError(name, evt, err)
+	}
+}
+
+// sleep waits for d, returning false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
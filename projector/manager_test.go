@@ -0,0 +1,317 @@
+package projector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/internal/natstest"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// countingProjector records the projected sequences, failing the first
+// failures calls for the events in failOn
+type countingProjector struct {
+	mu       sync.Mutex
+	seqs     []uint64
+	failOn   map[uint64]bool
+	failures int
+}
+
+func (c *countingProjector) Project(e *registry.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failOn[e.Sequence] && c.failures != 0 {
+		c.failures--
+		return errors.New("projection failed")
+	}
+	c.seqs = append(c.seqs, e.Sequence)
+	return nil
+}
+
+func (c *countingProjector) projected() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]uint64(nil), c.seqs...)
+}
+
+func newTestBackend() (*backend.InMemoryBackend, func(entityId string)) {
+	er := registry.NewEventRegistry()
+	codec := registry.NewJsonCodec(nil)
+	er.RegisterCodec(codec)
+	er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+		return &registry.Event{Type: "test-event", Timestamp: time.Now(), Meta: map[string]string{}}
+	}))
+	be := backend.NewInMemoryBackend()
+	be.SetEventRegistry(er)
+	be.Connect()
+	be.Setup("test-store", 1)
+	return be, func(entityId string) {
+		evt := er.NewEvent("test-event")
+		evt.EntityId = entityId
+		be.Save([]*registry.Event{evt}, backend.AnyVersion)
+	}
+}
+
+func TestManager(t *testing.T) {
+	convey.Convey("Given a manager fed by a backend with 3 events", t, func() {
+		be, add := newTestBackend()
+		add("e1")
+		add("e2")
+		add("e1")
+		cs := NewMemoryCheckpointStore()
+		m := NewManager(be, cs)
+		errs := make(chan error, 10)
+		m.SetErrorHandler(func(name string, evt *registry.Event, err error) { errs <- err })
+
+		convey.Convey("A projector should get the history and the new events", func() {
+			p := &countingProjector{}
+			assert.NoError(t, m.Register("all", p, Options{}))
+			assert.NoError(t, m.Start(context.Background()))
+			add("e2")
+			assert.Eventually(t, func() bool { return len(p.projected()) == 4 }, time.Second, 10*time.Millisecond)
+			m.Stop()
+			seq, _ := cs.Get("all")
+			assert.Equal(t, uint64(4), seq)
+
+			convey.Convey("After a restart it should resume from its checkpoint", func() {
+				add("e1")
+				p := &countingProjector{}
+				m := NewManager(be, cs)
+				m.Register("all", p, Options{})
+				m.Start(context.Background())
+				defer m.Stop()
+				assert.Eventually(t, func() bool { return len(p.projected()) == 1 }, time.Second, 10*time.Millisecond)
+				assert.Equal(t, []uint64{5}, p.projected())
+			})
+		})
+
+		convey.Convey("A projector should get only the events matching its filter", func() {
+			p := &countingProjector{}
+			m.Register("e1", p, Options{Filter: backend.Filter{EntityId: "e1"}})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return len(p.projected()) == 2 }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{1, 3}, p.projected())
+		})
+
+		convey.Convey("The Skip policy should move past a failing event", func() {
+			p := &countingProjector{failOn: map[uint64]bool{2: true}, failures: -1}
+			m.Register("skip", p, Options{OnError: Skip})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { seq, _ := cs.Get("skip"); return seq == 3 }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{1, 3}, p.projected())
+			assert.Error(t, <-errs)
+			assert.NoError(t, m.Err("skip"))
+		})
+
+		convey.Convey("The Halt policy should stop the projector before a failing event", func() {
+			p := &countingProjector{failOn: map[uint64]bool{2: true}, failures: -1}
+			m.Register("halt", p, Options{})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return m.Err("halt") != nil }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{1}, p.projected())
+			seq, _ := cs.Get("halt")
+			assert.Equal(t, uint64(1), seq)
+		})
+
+		convey.Convey("The Retry policy should project a failing event again", func() {
+			p := &countingProjector{failOn: map[uint64]bool{2: true}, failures: 2}
+			m.Register("retry", p, Options{OnError: Retry, RetryDelay: time.Millisecond})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return len(p.projected()) == 3 }, time.Second, 10*time.Millisecond)
+			assert.Len(t, errs, 2, "Expected 2 errors")
+		})
+
+		convey.Convey("The Retry policy should halt after MaxRetries", func() {
+			p := &countingProjector{failOn: map[uint64]bool{2: true}, failures: -1}
+			m.Register("retry", p, Options{OnError: Retry, MaxRetries: 2, RetryDelay: time.Millisecond})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return m.Err("retry") != nil }, time.Second, 10*time.Millisecond)
+			assert.Len(t, errs, 3, "Expected 3 errors")
+		})
+
+		convey.Convey("Registering a name twice should fail", func() {
+			m.Register("p", &countingProjector{}, Options{})
+			err := m.Register("p", &countingProjector{}, Options{})
+			assert.ErrorIs(t, err, ErrProjectorExists)
+			assert.ErrorIs(t, m.Err("unknown"), ErrUnknownProjector)
+		})
+
+		convey.Convey("Starting twice should fail", func() {
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.ErrorIs(t, m.Start(context.Background()), ErrManagerStarted)
+		})
+	})
+}
+
+func TestManager_Rebuild(t *testing.T) {
+	convey.Convey("Given a running manager with a projector", t, func() {
+		be, add := newTestBackend()
+		for i := 0; i < 20; i++ {
+			add("e1")
+		}
+		cs := NewMemoryCheckpointStore()
+		m := NewManager(be, cs)
+		old := &countingProjector{}
+		m.Register("p", old, Options{})
+		m.Start(context.Background())
+		defer m.Stop()
+		assert.Eventually(t, func() bool { return len(old.projected()) == 20 }, time.Second, 10*time.Millisecond)
+
+		convey.Convey("When rebuilding it while events are added", func() {
+			stop := make(chan struct{})
+			writing := make(chan struct{})
+			go func() {
+				defer close(writing)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						add("e1")
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}()
+			next := &countingProjector{}
+			err := m.Rebuild(context.Background(), "p", next)
+			close(stop)
+			<-writing
+			add("e1")
+
+			convey.Convey("The new projector should replace the old one without gaps", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				current, _ := m.Projector("p")
+				assert.Same(t, next, current)
+
+				version, _ := be.Version("e1")
+				assert.Eventually(t, func() bool { return uint64(len(next.projected())) == version }, time.Second, 10*time.Millisecond)
+				for i, seq := range next.projected() {
+					assert.Equal(t, uint64(i+1), seq)
+				}
+				oldSeqs := old.projected()
+				assert.Less(t, oldSeqs[len(oldSeqs)-1], version, "Expected the old projector to stop before the last event")
+				seq, _ := cs.Get("p")
+				assert.Equal(t, version, seq)
+			})
+		})
+
+		convey.Convey("When the rebuilt projector fails", func() {
+			next := &countingProjector{failOn: map[uint64]bool{5: true}, failures: -1}
+			err := m.Rebuild(context.Background(), "p", next)
+
+			convey.Convey("The old projector should keep running", func() {
+				assert.Error(t, err, "Expected an error")
+				current, _ := m.Projector("p")
+				assert.Same(t, old, current)
+				add("e1")
+				assert.Eventually(t, func() bool { return len(old.projected()) == 21 }, time.Second, 10*time.Millisecond)
+			})
+		})
+
+		convey.Convey("Rebuilding an unknown projector should fail", func() {
+			err := m.Rebuild(context.Background(), "unknown", &countingProjector{})
+			assert.ErrorIs(t, err, ErrUnknownProjector)
+		})
+	})
+
+	convey.Convey("Given a halted projector", t, func() {
+		be, add := newTestBackend()
+		for i := 0; i < 3; i++ {
+			add("e1")
+		}
+		m := NewManager(be, NewMemoryCheckpointStore())
+		m.Register("p", &countingProjector{failOn: map[uint64]bool{2: true}, failures: -1}, Options{})
+		m.Start(context.Background())
+		defer m.Stop()
+		assert.Eventually(t, func() bool { return m.Err("p") != nil }, time.Second, 10*time.Millisecond)
+
+		convey.Convey("Rebuilding it with a fixed projector should restart it", func() {
+			next := &countingProjector{}
+			err := m.Rebuild(context.Background(), "p", next)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.NoError(t, m.Err("p"))
+			add("e1")
+			assert.Eventually(t, func() bool { return len(next.projected()) == 4 }, time.Second, 10*time.Millisecond)
+		})
+	})
+
+	convey.Convey("Given a manager not started", t, func() {
+		be, add := newTestBackend()
+		add("e1")
+		add("e1")
+		cs := NewMemoryCheckpointStore()
+		m := NewManager(be, cs)
+		m.Register("p", &countingProjector{}, Options{})
+
+		convey.Convey("The rebuilt projector should get the history once started", func() {
+			next := &countingProjector{}
+			err := m.Rebuild(context.Background(), "p", next)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return len(next.projected()) == 2 }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{1, 2}, next.projected())
+			seq, _ := cs.Get("p")
+			assert.Equal(t, uint64(2), seq)
+		})
+	})
+}
+
+func TestManager_NATS(t *testing.T) {
+	convey.Convey("Given a manager fed by a NATS backend with a batch", t, func() {
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(nil)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{Type: "test-event", Timestamp: time.Now(), Meta: map[string]string{}}
+		}))
+		be := backend.NewNATSBackend(backend.NATSBackendConfig{Connection: natstest.RunServer(t)})
+		be.SetEventRegistry(er)
+		assert.NoError(t, be.Connect())
+		defer be.Close()
+		assert.NoError(t, be.Setup("test-store", 1))
+		add := func(entityId string, n int) {
+			events := []*registry.Event{}
+			for i := 0; i < n; i++ {
+				evt := er.NewEvent("test-event")
+				evt.EntityId = entityId
+				events = append(events, evt)
+			}
+			_, err := be.Save(events, backend.AnyVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+		}
+		add("e1", 3)
+		add("e2", 1)
+		cs := NewMemoryCheckpointStore()
+
+		convey.Convey("A projector checkpointed in the middle of the batch should resume right after it", func() {
+			cs.Set("p", 2)
+			p := &countingProjector{}
+			m := NewManager(be, cs)
+			m.Register("p", p, Options{})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { return len(p.projected()) == 2 }, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{3, 4}, p.projected())
+
+			convey.Convey("And checkpoint the new events in order", func() {
+				add("e1", 2)
+				assert.Eventually(t, func() bool { seq, _ := cs.Get("p"); return seq == 6 }, 5*time.Second, 10*time.Millisecond)
+				assert.Equal(t, []uint64{3, 4, 5, 6}, p.projected())
+			})
+		})
+	})
+}
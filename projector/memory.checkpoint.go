@@ -0,0 +1,44 @@
+package projector
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryCheckpointStore is a CheckpointStore keeping the checkpoints in process memory,
+// it is safe for concurrent use
+type MemoryCheckpointStore struct {
+	mu          sync.RWMutex
+	checkpoints map[string]uint64
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: make(map[string]uint64)}
+}
+
+func (m *MemoryCheckpointStore) Get(name string) (uint64, error) {
+	return m.GetCtx(context.Background(), name)
+}
+
+func (m *MemoryCheckpointStore) GetCtx(ctx context.Context, name string) (uint64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.checkpoints[name], nil
+}
+
+func (m *MemoryCheckpointStore) Set(name string, seq uint64) error {
+	return m.SetCtx(context.Background(), name, seq)
+}
+
+func (m *MemoryCheckpointStore) SetCtx(ctx context.Context, name string, seq uint64) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[name] = seq
+	return nil
+}
@@ -0,0 +1,83 @@
+package projector
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lucacox/event-sourcing/internal/kvbucket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// defaultTimeout bounds the methods that do not take a context
+const defaultTimeout = 20 * time.Second
+
+type NATSCheckpointStoreConfig struct {
+	// Bucket is the name of the Key-Value bucket, "checkpoints" if empty
+	Bucket string
+	// Replicas of the bucket, 1 if zero
+	Replicas int
+}
+
+// NATSCheckpointStore keeps the checkpoints in a JetStream Key-Value bucket, created on
+// first use. Checkpoints are stored by projector name, so names must be valid NATS KV keys
+type NATSCheckpointStore struct {
+	opts   NATSCheckpointStoreConfig
+	bucket *kvbucket.Bucket
+}
+
+func NewNATSCheckpointStore(nc *nats.Conn, opt NATSCheckpointStoreConfig) (*NATSCheckpointStore, error) {
+	if opt.Bucket == "" {
+		opt.Bucket = "checkpoints"
+	}
+	if opt.Replicas == 0 {
+		opt.Replicas = 1
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	bucket := kvbucket.New(js, jetstream.KeyValueConfig{
+		Bucket:   opt.Bucket,
+		Replicas: opt.Replicas,
+	})
+	return &NATSCheckpointStore{opts: opt, bucket: bucket}, nil
+}
+
+func (ncs *NATSCheckpointStore) Get(name string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return ncs.GetCtx(ctx, name)
+}
+
+func (ncs *NATSCheckpointStore) GetCtx(ctx context.Context, name string) (uint64, error) {
+	kv, err := ncs.bucket.Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	entry, err := kv.Get(ctx, name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(entry.Value()), 10, 64)
+}
+
+func (ncs *NATSCheckpointStore) Set(name string, seq uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return ncs.SetCtx(ctx, name, seq)
+}
+
+func (ncs *NATSCheckpointStore) SetCtx(ctx context.Context, name string, seq uint64) error {
+	kv, err := ncs.bucket.Get(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, name, []byte(strconv.FormatUint(seq, 10)))
+	return err
+}
@@ -0,0 +1,81 @@
+package projector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/internal/natstest"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+func TestNATSCheckpointStore(t *testing.T) {
+	convey.Convey("Given a NATS checkpoint store on an embedded server", t, func() {
+		url := natstest.RunServer(t)
+		nc, err := nats.Connect(url)
+		if err != nil {
+			t.Fatalf("cannot connect to the NATS server: %v", err)
+		}
+		t.Cleanup(nc.Close)
+		cs, err := NewNATSCheckpointStore(nc, NATSCheckpointStoreConfig{})
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+
+		convey.Convey("A missing checkpoint should be 0", func() {
+			seq, err := cs.Get("devices")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(0), seq)
+		})
+
+		convey.Convey("A checkpoint should survive a new store on the same bucket", func() {
+			assert.NoError(t, cs.Set("devices", 41))
+			assert.NoError(t, cs.Set("devices", 42))
+			cs, _ := NewNATSCheckpointStore(nc, NATSCheckpointStoreConfig{})
+			seq, err := cs.Get("devices")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(42), seq)
+		})
+
+		convey.Convey("A restarted manager should resume after its checkpoint", func() {
+			er := registry.NewEventRegistry()
+			codec := registry.NewJsonCodec(nil)
+			er.RegisterCodec(codec)
+			er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+				return &registry.Event{Type: "test-event", Timestamp: time.Now(), Meta: map[string]string{}}
+			}))
+			be := backend.NewNATSBackend(backend.NATSBackendConfig{Connection: url})
+			be.SetEventRegistry(er)
+			assert.NoError(t, be.Connect())
+			defer be.Close()
+			assert.NoError(t, be.Setup("test-store", 1))
+			add := func() {
+				evt := er.NewEvent("test-event")
+				evt.EntityId = "e1"
+				_, err := be.Save([]*registry.Event{evt}, backend.AnyVersion)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+			}
+			add()
+			add()
+
+			p := &countingProjector{}
+			m := NewManager(be, cs)
+			m.Register("p", p, Options{})
+			m.Start(context.Background())
+			assert.Eventually(t, func() bool { seq, _ := cs.Get("p"); return seq == 2 }, 5*time.Second, 10*time.Millisecond)
+			m.Stop()
+
+			add()
+			p = &countingProjector{}
+			m = NewManager(be, cs)
+			m.Register("p", p, Options{})
+			m.Start(context.Background())
+			defer m.Stop()
+			assert.Eventually(t, func() bool { seq, _ := cs.Get("p"); return seq == 3 }, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, []uint64{3}, p.projected())
+		})
+	})
+}
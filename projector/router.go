@@ -0,0 +1,74 @@
+package projector
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// ErrUnknownEvent is returned by a Router rejecting the events it has no handler for
+var ErrUnknownEvent = errors.New("no handler for event type")
+
+// HandlerFunc projects a single event
+type HandlerFunc func(*registry.Event) error
+
+// Router is a Projector dispatching each event to the handler registered for
+// its type. Events without handler go to the fallback handler if set, otherwise
+// they are ignored or rejected with ErrUnknownEvent. Handlers must be registered
+// before the router is used
+type Router struct {
+	handlers map[string]HandlerFunc
+	fallback HandlerFunc
+	reject   bool
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+// On registers the handler of an event type, replacing the previous one.
+// Returns the router so calls can be chained
+func (r *Router) On(eventType string, h HandlerFunc) *Router {
+	r.handlers[eventType] = h
+	return r
+}
+
+// OnTyped registers a handler receiving the event payload as a T, converted with
+// registry.PayloadAs. Redacted events have no payload and are skipped
+func OnTyped[T any](r *Router, eventType string, h func(*registry.Event, T) error) *Router {
+	return r.On(eventType, func(e *registry.Event) error {
+		if e.Redacted {
+			return nil
+		}
+		payload, err := registry.PayloadAs[T](e)
+		if err != nil {
+			return err
+		}
+		return h(e, payload)
+	})
+}
+
+// SetFallback sets the handler of the events with no registered handler
+func (r *Router) SetFallback(h HandlerFunc) {
+	r.fallback = h
+}
+
+// SetRejectUnknown makes the router fail on events with no handler, when no
+// fallback is set, instead of ignoring them
+func (r *Router) SetRejectUnknown(enabled bool) {
+	r.reject = enabled
+}
+
+func (r *Router) Project(e *registry.Event) error {
+	if h, ok := r.handlers[e.Type]; ok {
+		return h(e)
+	}
+	if r.fallback != nil {
+		return r.fallback(e)
+	}
+	if r.reject {
+		return fmt.Errorf("%w %q", ErrUnknownEvent, e.Type)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package projector
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+type devicePayload struct {
+	Serial string `json:"serial"`
+}
+
+func TestRouter(t *testing.T) {
+	convey.Convey("Given a router with handlers for two event types", t, func() {
+		var handled []string
+		r := NewRouter().
+			On("created", func(e *registry.Event) error {
+				handled = append(handled, "created")
+				return nil
+			})
+		OnTyped(r, "updated", func(e *registry.Event, p devicePayload) error {
+			handled = append(handled, "updated:"+p.Serial)
+			return nil
+		})
+
+		convey.Convey("Events should be dispatched by type", func() {
+			assert.NoError(t, r.Project(&registry.Event{Type: "created"}))
+			assert.NoError(t, r.Project(&registry.Event{Type: "updated", Payload: devicePayload{Serial: "a"}}))
+			assert.NoError(t, r.Project(&registry.Event{Type: "updated", Payload: map[string]interface{}{"serial": "b"}}))
+			assert.Equal(t, []string{"created", "updated:a", "updated:b"}, handled)
+		})
+
+		convey.Convey("Typed handlers should skip redacted events", func() {
+			assert.NoError(t, r.Project(&registry.Event{Type: "updated", Redacted: true}))
+			assert.Empty(t, handled)
+		})
+
+		convey.Convey("Typed handlers should fail on unexpected payloads", func() {
+			err := r.Project(&registry.Event{Type: "updated", Payload: 42})
+			assert.ErrorIs(t, err, registry.ErrPayloadType)
+		})
+
+		convey.Convey("Unknown events should be ignored by default", func() {
+			assert.NoError(t, r.Project(&registry.Event{Type: "deleted"}))
+			assert.Empty(t, handled)
+		})
+
+		convey.Convey("Unknown events should be rejected if enabled", func() {
+			r.SetRejectUnknown(true)
+			err := r.Project(&registry.Event{Type: "deleted"})
+			assert.ErrorIs(t, err, ErrUnknownEvent)
+		})
+
+		convey.Convey("Unknown events should go to the fallback handler", func() {
+			r.SetRejectUnknown(true)
+			r.SetFallback(func(e *registry.Event) error {
+				handled = append(handled, "fallback:"+e.Type)
+				return nil
+			})
+			assert.NoError(t, r.Project(&registry.Event{Type: "deleted"}))
+			assert.Equal(t, []string{"fallback:deleted"}, handled)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+// cbor modes: timestamps are tagged RFC 3339 strings keeping nanoseconds as
+// JSON does, float epoch times would lose them. Generic maps decode as
+// map[string]interface{} as with JSON
+var (
+	cborEnc, _ = cbor.EncOptions{
+		Time:    cbor.TimeRFC3339Nano,
+		TimeTag: cbor.EncTagRequired,
+	}.EncMode()
+	cborDec, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+)
+
+// CBORCodec encodes events as CBOR, with the same envelope and payload field
+// names of JsonCodec: struct fields use their cbor tags, or json ones if missing.
+// Payloads that are already CBOR can be stored as is using cbor.RawMessage
+type CBORCodec struct {
+	payloadCodec
+}
+
+// NewCBORCodec creates a CBOR codec, if ks is not nil payloads of entities
+// having a key in the store are encrypted
+func NewCBORCodec(ks keystore.KeyStore) *CBORCodec {
+	return &CBORCodec{payloadCodec{ks: ks, marshal: cborEnc.Marshal, unmarshal: cborDec.Unmarshal}}
+}
+
+// SetMapPayloads makes Decode always return payloads as generic values
+// (map[string]interface{} for maps) instead of the EventType payload type
+func (cc *CBORCodec) SetMapPayloads(enabled bool) {
+	cc.mapPayloads = enabled
+}
+
+func (cc *CBORCodec) Name() string {
+	return "CBOR Codec"
+}
+
+// Decode fills target as JsonCodec.Decode does. Generic values use uint64
+// and int64 for integers
+func (cc *CBORCodec) Decode(data []byte, target *Event) error {
+	prototype := target.Payload
+
+	var raw rawEvent[cbor.RawMessage]
+	err := cborDec.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	raw.fill(target)
+	return cc.decodePayload(context.Background(), raw.Payload, NoCompression, target, prototype)
+}
+
+func (cc *CBORCodec) Encode(e *Event) ([]byte, error) {
+	e, err := cc.encrypt(context.Background(), e)
+	if err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(e)
+}
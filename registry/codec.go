@@ -1,7 +1,65 @@
 package registry
 
+import (
+	"context"
+	"strings"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
 type Codec interface {
 	Name() string
 	Encode(*Event) ([]byte, error)
 	Decode([]byte, *Event) error
 }
+
+// PayloadCodec is implemented by codecs able to encode the payload alone, the
+// other event fields travel in an Envelope
+type PayloadCodec interface {
+	Codec
+	// EncodePayload encodes the payload of e, recording in env how it was
+	// encoded (Encrypted, Compression). The entity key is read through the cache of ctx,
+	// if any (see keystore.WithKeyCache)
+	EncodePayload(ctx context.Context, e *Event, env *Envelope) ([]byte, error)
+	// DecodePayload decodes data into the payload of target, whose other
+	// fields are already set from env. target.Payload holds the prototype
+	// set by EventType.Init
+	DecodePayload(ctx context.Context, env *Envelope, data []byte, target *Event) error
+}
+
+// KeyStoreCodec is implemented by codecs encrypting payloads with per-entity keys
+type KeyStoreCodec interface {
+	Codec
+	// KeyStore returns the store of the keys, nil if payloads are not encrypted
+	KeyStore() keystore.KeyStore
+}
+
+// HeaderCodec is implemented by codecs adding parameters to the codec name
+// that backends store along with the event, such as the payload type
+type HeaderCodec interface {
+	Codec
+	// Header returns the codec header of the encoded event, in the form
+	// "<name>; <key>=<value>; ..."
+	Header(*Event) string
+}
+
+// CodecHeader returns the codec header for an event encoded with codec
+func CodecHeader(codec Codec, e *Event) string {
+	if hc, ok := codec.(HeaderCodec); ok {
+		return hc.Header(e)
+	}
+	return codec.Name()
+}
+
+// ParseCodecHeader splits a codec header into the codec name and its parameters
+func ParseCodecHeader(header string) (string, map[string]string) {
+	parts := strings.Split(header, ";")
+	params := make(map[string]string)
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if key != "" {
+			params[key] = value
+		}
+	}
+	return strings.TrimSpace(parts[0]), params
+}
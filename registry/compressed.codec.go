@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+// compressingCodec is implemented by the codecs of this package, that compress
+// the encoded payload before encrypting it
+type compressingCodec interface {
+	encodeCompressed(ctx context.Context, e *Event, env *Envelope, algorithm Compression, threshold int) ([]byte, error)
+}
+
+// CompressedCodec wraps a Codec compressing the payloads it encodes when they
+// are at least threshold bytes long. The algorithm is stored in the envelope of
+// each event, so events compressed with another algorithm, or not compressed at
+// all, decode too. The codecs of this package compress the payload before
+// encrypting it, other codecs get their encoding compressed
+type CompressedCodec struct {
+	codec     Codec
+	algorithm Compression
+	threshold int
+}
+
+// NewCompressedCodec creates a codec compressing the payloads encoded by codec
+// with algorithm, payloads shorter than threshold bytes are stored uncompressed
+func NewCompressedCodec(codec Codec, algorithm Compression, threshold int) *CompressedCodec {
+	return &CompressedCodec{codec: codec, algorithm: algorithm, threshold: threshold}
+}
+
+// Name returns the wrapped codec name prefixed by "Compressed"
+func (cc *CompressedCodec) Name() string {
+	return "Compressed " + cc.codec.Name()
+}
+
+// Unwrap returns the wrapped codec
+func (cc *CompressedCodec) Unwrap() Codec {
+	return cc.codec
+}
+
+// KeyStore returns the KeyStore of the wrapped codec, nil if it does not encrypt payloads
+func (cc *CompressedCodec) KeyStore() keystore.KeyStore {
+	if kc, ok := cc.codec.(KeyStoreCodec); ok {
+		return kc.KeyStore()
+	}
+	return nil
+}
+
+// Header returns the codec name along with the parameters of the wrapped codec
+func (cc *CompressedCodec) Header(e *Event) string {
+	header := cc.Name()
+	if hc, ok := cc.codec.(HeaderCodec); ok {
+		if _, params, found := strings.Cut(hc.Header(e), ";"); found {
+			header += ";" + params
+		}
+	}
+	return header
+}
+
+// Encode compresses the whole event encoded by the wrapped codec, there is no
+// envelope so the algorithm is stored as the first byte
+func (cc *CompressedCodec) Encode(e *Event) ([]byte, error) {
+	data, err := cc.codec.Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	data, algorithm, err := compress(data, cc.algorithm, cc.threshold)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(algorithm)}, data...), nil
+}
+
+// Decode decodes an event encoded by Encode
+func (cc *CompressedCodec) Decode(data []byte, target *Event) error {
+	if len(data) == 0 {
+		return fmt.Errorf("cannot decode event: no compression algorithm")
+	}
+	data, err := decompress(data[1:], Compression(data[0]))
+	if err != nil {
+		return err
+	}
+	return cc.codec.Decode(data, target)
+}
+
+// EncodePayload encodes the payload with the wrapped codec, compressed before
+// being encrypted, and sets the algorithm used in env. Codecs not implementing
+// PayloadCodec encode the whole event
+func (cc *CompressedCodec) EncodePayload(ctx context.Context, e *Event, env *Envelope) ([]byte, error) {
+	var data []byte
+	var err error
+	switch codec := cc.codec.(type) {
+	case compressingCodec:
+		return codec.encodeCompressed(ctx, e, env, cc.algorithm, cc.threshold)
+	case PayloadCodec:
+		data, err = codec.EncodePayload(ctx, e, env)
+	default:
+		data, err = codec.Encode(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, env.Compression, err = compress(data, cc.algorithm, cc.threshold)
+	return data, err
+}
+
+// DecodePayload decodes a payload encoded by EncodePayload, decompressing it
+// with the algorithm of env
+func (cc *CompressedCodec) DecodePayload(ctx context.Context, env *Envelope, data []byte, target *Event) error {
+	if _, ok := cc.codec.(compressingCodec); ok {
+		return cc.codec.(PayloadCodec).DecodePayload(ctx, env, data, target)
+	}
+	data, err := decompress(data, env.Compression)
+	if err != nil {
+		return err
+	}
+	if pc, ok := cc.codec.(PayloadCodec); ok {
+		plain := *env
+		plain.Compression = NoCompression
+		return pc.DecodePayload(ctx, &plain, data, target)
+	}
+	return cc.codec.Decode(data, target)
+}
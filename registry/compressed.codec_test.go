@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+func TestCompressedCodec(t *testing.T) {
+	ctx := context.Background()
+	large := map[string]interface{}{"config": strings.Repeat("interface eth0 up; ", 200)}
+	small := map[string]interface{}{"config": "up"}
+
+	for _, algorithm := range []Compression{Zstd, S2} {
+		convey.Convey("Given a JSON codec compressed with "+algorithm.String(), t, func() {
+			ks := keystore.NewMemoryKeyStore()
+			ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+			plainCodec := NewJsonCodec(ks)
+			codec := NewCompressedCodec(plainCodec, algorithm, 256)
+
+			convey.Convey("Large payloads should be compressed", func() {
+				evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-2", Payload: large}
+				plain, _ := plainCodec.EncodePayload(ctx, evt, &Envelope{})
+				env := &Envelope{}
+				data, err := codec.EncodePayload(ctx, evt, env)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, algorithm, env.Compression)
+				assert.Less(t, len(data), len(plain))
+
+				target := &Event{EntityId: "entity-2"}
+				err = codec.DecodePayload(ctx, env, data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, large, target.Payload)
+			})
+
+			convey.Convey("Encrypted payloads should be compressed before encryption", func() {
+				evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-1", Payload: large}
+				plain, _ := plainCodec.EncodePayload(ctx, evt, &Envelope{})
+				env := &Envelope{}
+				data, err := codec.EncodePayload(ctx, evt, env)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.True(t, env.Encrypted, "Expected payload to be encrypted")
+				assert.Equal(t, algorithm, env.Compression)
+				assert.Less(t, len(data), len(plain)/2)
+
+				target := &Event{Id: "event-1", EntityId: "entity-1", Encrypted: true}
+				err = codec.DecodePayload(ctx, env, data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, large, target.Payload)
+			})
+
+			convey.Convey("Payloads below the threshold should be stored uncompressed", func() {
+				evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-2", Payload: small}
+				env := &Envelope{}
+				data, err := codec.EncodePayload(ctx, evt, env)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, NoCompression, env.Compression)
+				assert.JSONEq(t, `{"config":"up"}`, string(data))
+			})
+
+			convey.Convey("Whole events should be compressed too", func() {
+				evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-2", Payload: large}
+				plain, _ := plainCodec.Encode(evt)
+				data, err := codec.Encode(evt)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Less(t, len(data), len(plain))
+
+				target := &Event{EntityId: "entity-2"}
+				err = codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, large, target.Payload)
+			})
+
+			convey.Convey("Payloads stored without compression should decode", func() {
+				evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-2", Payload: large}
+				env := &Envelope{}
+				data, _ := plainCodec.EncodePayload(ctx, evt, env)
+				target := &Event{EntityId: "entity-2"}
+				err := codec.DecodePayload(ctx, env, data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, large, target.Payload)
+			})
+		})
+	}
+
+	convey.Convey("Given a Protobuf codec compressed with zstd", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+		codec := NewCompressedCodec(NewProtobufCodec(ks), Zstd, 256)
+
+		convey.Convey("Large encrypted messages should be compressed and decode back", func() {
+			msg := wrapperspb.String(strings.Repeat("interface eth0 up; ", 200))
+			evt := &Event{Id: "event-1", Type: "config", EntityId: "entity-1", Payload: msg}
+			env := &Envelope{}
+			data, err := codec.EncodePayload(ctx, evt, env)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.True(t, env.Encrypted, "Expected payload to be encrypted")
+			assert.Equal(t, Zstd, env.Compression)
+			assert.Less(t, len(data), len(msg.Value)/2)
+
+			target := &Event{Id: "event-1", EntityId: "entity-1", Encrypted: true, Payload: &wrapperspb.StringValue{}}
+			err = codec.DecodePayload(ctx, env, data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, msg.Value, target.Payload.(*wrapperspb.StringValue).Value)
+		})
+	})
+
+	convey.Convey("Given a codec that does not encode payloads alone", t, func() {
+		codec := NewCompressedCodec(wholeEventCodec{}, S2, 0)
+
+		convey.Convey("Its whole event encoding should be compressed as the payload", func() {
+			evt := &Event{Id: "event-1", Type: "config", Payload: large}
+			env := &Envelope{}
+			data, err := codec.EncodePayload(ctx, evt, env)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, S2, env.Compression)
+
+			target := &Event{}
+			err = codec.DecodePayload(ctx, env, data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, large, target.Payload)
+		})
+	})
+
+	convey.Convey("Given a registry with a compressed JSON codec", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		jsonCodec := NewJsonCodec(ks)
+		codec := NewCompressedCodec(jsonCodec, Zstd, 0)
+		er := NewEventRegistry()
+		er.RegisterCodec(codec)
+
+		convey.Convey("The wrapped codec should be registered too", func() {
+			assert.Equal(t, codec, er.GetCodec("Compressed JSON Codec"))
+			assert.Equal(t, jsonCodec, er.GetCodec("JSON Codec"))
+			registered, err := er.KeyStore()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, ks, registered)
+		})
+	})
+
+	convey.Convey("Compression names should parse back", t, func() {
+		for _, algorithm := range []Compression{NoCompression, Zstd, S2} {
+			parsed, err := ParseCompression(algorithm.String())
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, algorithm, parsed)
+		}
+		_, err := ParseCompression("lz4")
+		assert.Error(t, err, "Expected an error")
+	})
+}
@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm compressing the payloads encoded by CompressedCodec,
+// it is stored in the event Envelope
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Zstd
+	S2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Zstd:
+		return "zstd"
+	case S2:
+		return "s2"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// ParseCompression returns the algorithm named name, as returned by String
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{NoCompression, Zstd, S2} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return NoCompression, fmt.Errorf("unknown compression %q", name)
+}
+
+// zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+// calls, they are shared by all the codecs and created on first use
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil)
+	})
+)
+
+// compress compresses data with algorithm if it is at least threshold bytes long,
+// returning the algorithm used
+func compress(data []byte, algorithm Compression, threshold int) ([]byte, Compression, error) {
+	if algorithm == NoCompression || len(data) < threshold {
+		return data, NoCompression, nil
+	}
+	switch algorithm {
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, NoCompression, err
+		}
+		return enc.EncodeAll(data, nil), Zstd, nil
+	case S2:
+		return s2.Encode(nil, data), S2, nil
+	}
+	return nil, NoCompression, fmt.Errorf("unsupported compression %s", algorithm)
+}
+
+// decompress reverses compress
+func decompress(data []byte, algorithm Compression) ([]byte, error) {
+	switch algorithm {
+	case NoCompression:
+		return data, nil
+	case Zstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	case S2:
+		return s2.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", algorithm)
+}
@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Envelope holds the event fields stored apart from the payload, so that
+// backends can expose them, e.g. as message headers, and tools can route and
+// filter events without decoding their payload
+type Envelope struct {
+	Id       string
+	Type     string
+	EntityId string
+	// Timestamp is the event creation time
+	Timestamp time.Time
+	// Version is the payload schema version
+	Version int
+	// Encrypted is set by the codec when the payload is encrypted
+	Encrypted bool
+	// Compression is set by the codec when the payload is compressed
+	Compression Compression
+	// Codec is the codec header: the codec name and its parameters
+	Codec string
+	Meta  map[string]string
+}
+
+// Envelope returns the envelope of the event, Codec and Encrypted are set
+// when the payload is encoded
+func (e *Event) Envelope() *Envelope {
+	meta := make(map[string]string, len(e.Meta))
+	for k, v := range e.Meta {
+		meta[k] = v
+	}
+	return &Envelope{
+		Id:        e.Id,
+		Type:      e.Type,
+		EntityId:  e.EntityId,
+		Timestamp: e.Timestamp,
+		Version:   e.Version,
+		Meta:      meta,
+	}
+}
+
+// SerializePayload encodes the event payload with the codec of its type,
+// returning it along with the event envelope. Codecs not implementing
+// PayloadCodec encode the whole event
+func (e *Event) SerializePayload() (*Envelope, []byte, error) {
+	return e.SerializePayloadCtx(context.Background())
+}
+
+// SerializePayloadCtx is like SerializePayload but the entity key is read with
+// ctx, through its key cache if any
+func (e *Event) SerializePayloadCtx(ctx context.Context) (*Envelope, []byte, error) {
+	codec, err := e.codec()
+	if err != nil {
+		return nil, nil, err
+	}
+	env := e.Envelope()
+	var data []byte
+	if pc, ok := codec.(PayloadCodec); ok {
+		data, err = pc.EncodePayload(ctx, e, env)
+	} else {
+		data, err = codec.Encode(e)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	env.Codec = CodecHeader(codec, e)
+	return env, data, nil
+}
+
+// DeserializePayload fills the event from env and decodes data, encoded by
+// SerializePayload, into its payload. The codec is the one named by env, so
+// events stored with a codec other than the current one of their type decode too
+func (e *Event) DeserializePayload(env *Envelope, data []byte) error {
+	return e.DeserializePayloadCtx(context.Background(), env, data)
+}
+
+// DeserializePayloadCtx is like DeserializePayload but the entity key is read with
+// ctx, through its key cache if any
+func (e *Event) DeserializePayloadCtx(ctx context.Context, env *Envelope, data []byte) error {
+	name, _ := ParseCodecHeader(env.Codec)
+	codec := e.Registry.GetCodec(name)
+	if codec == nil {
+		return fmt.Errorf("unknown codec %q", name)
+	}
+	e.Id = env.Id
+	e.Type = env.Type
+	e.EntityId = env.EntityId
+	e.Timestamp = env.Timestamp
+	e.Version = env.Version
+	e.Encrypted = env.Encrypted
+	e.Meta = make(map[string]string, len(env.Meta))
+	for k, v := range env.Meta {
+		e.Meta[k] = v
+	}
+	if pc, ok := codec.(PayloadCodec); ok {
+		return pc.DecodePayload(ctx, env, data, e)
+	}
+	return codec.Decode(data, e)
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+// wholeEventCodec is a codec encoding the whole event, not a PayloadCodec
+type wholeEventCodec struct{}
+
+func (wholeEventCodec) Name() string                       { return "Whole Event Codec" }
+func (wholeEventCodec) Encode(e *Event) ([]byte, error)    { return json.Marshal(e) }
+func (wholeEventCodec) Decode(data []byte, e *Event) error { return json.Unmarshal(data, e) }
+
+func TestEvent_SerializePayload(t *testing.T) {
+	convey.Convey("Given an event of a type using a payload codec", t, func() {
+		er := NewEventRegistry()
+		RegisterTyped[testDevicePayload](er, "device-created", NewJsonCodec(nil))
+		evt, _ := NewTypedEvent(er, testDevicePayload{Serial: "123"})
+		evt.EntityId = "device-1"
+		evt.Timestamp = time.Date(2024, 5, 1, 10, 0, 0, 123, time.UTC)
+		evt.Meta[MetaActor] = "john"
+
+		convey.Convey("When serializing its payload", func() {
+			env, data, err := evt.SerializePayload()
+
+			convey.Convey("The envelope should hold the other event fields", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, evt.Id, env.Id)
+				assert.Equal(t, "device-created", env.Type)
+				assert.Equal(t, "device-1", env.EntityId)
+				assert.Equal(t, evt.Timestamp, env.Timestamp)
+				assert.Equal(t, 1, env.Version)
+				assert.Equal(t, "JSON Codec", env.Codec)
+				assert.Equal(t, map[string]string{MetaActor: "john"}, env.Meta)
+			})
+
+			convey.Convey("The data should hold the payload alone", func() {
+				assert.JSONEq(t, `{"serial":"123","mac_addresses":null}`, string(data))
+			})
+
+			convey.Convey("Deserializing should restore the event", func() {
+				target := er.NewEvent("device-created")
+				err := target.DeserializePayload(env, data)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, evt.Id, target.Id)
+				assert.Equal(t, "device-1", target.EntityId)
+				assert.Equal(t, evt.Meta, target.Meta)
+				assert.Equal(t, testDevicePayload{Serial: "123"}, target.Payload)
+			})
+		})
+	})
+
+	convey.Convey("Given an event of a type using a codec encoding the whole event", t, func() {
+		er := NewEventRegistry()
+		er.RegisterCodec(wholeEventCodec{})
+		er.Register(NewEventType("note", "Whole Event Codec", func() *Event {
+			return &Event{Type: "note", Meta: map[string]string{}}
+		}))
+		evt := er.NewEvent("note")
+		evt.EntityId = "note-1"
+		evt.Payload = "hello"
+
+		convey.Convey("The whole event should be serialized and restored", func() {
+			env, data, err := evt.SerializePayload()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Contains(t, string(data), evt.Id)
+
+			target := er.NewEvent("note")
+			err = target.DeserializePayload(env, data)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, "note-1", target.EntityId)
+			assert.Equal(t, "hello", target.Payload)
+		})
+	})
+}
@@ -1,16 +1,29 @@
 package registry
 
-import "github.com/google/uuid"
+import (
+	"errors"
+	"reflect"
+
+	"github.com/google/uuid"
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+// ErrKeyStoreMismatch is returned by KeyStore when the codecs encrypt payloads
+// with keys of different stores
+var ErrKeyStoreMismatch = errors.New("codecs use different key stores")
 
 type EventRegistry struct {
 	types  map[string]*EventType
 	codecs map[string]Codec
+	// event type names by payload type, filled by RegisterTyped
+	payloadTypes map[reflect.Type]string
 }
 
 func NewEventRegistry() *EventRegistry {
 	return &EventRegistry{
-		types:  make(map[string]*EventType),
-		codecs: make(map[string]Codec),
+		types:        make(map[string]*EventType),
+		codecs:       make(map[string]Codec),
+		payloadTypes: make(map[reflect.Type]string),
 	}
 }
 
@@ -29,14 +42,39 @@ func (er *EventRegistry) NewEvent(name string) *Event {
 	}
 	evt := et.Init()
 	evt.Id = uuid.New().String()
+	evt.Version = et.CurrentVersion()
 	evt.Registry = er
 	return evt
 }
 
+// RegisterCodec registers codec by its name. Codecs wrapping another one, such
+// as CompressedCodec, register the wrapped codec too if missing, it decodes
+// the events stored before the wrapper was used
 func (er *EventRegistry) RegisterCodec(codec Codec) {
 	er.codecs[codec.Name()] = codec
+	if w, ok := codec.(interface{ Unwrap() Codec }); ok && er.GetCodec(w.Unwrap().Name()) == nil {
+		er.RegisterCodec(w.Unwrap())
+	}
 }
 
 func (er *EventRegistry) GetCodec(name string) Codec {
 	return er.codecs[name]
 }
+
+// KeyStore returns the KeyStore of the codecs encrypting payloads, nil if no codec
+// encrypts them. All the codecs are expected to share the same KeyStore, so that
+// deleting a key forgets the entity whatever codec its events use
+func (er *EventRegistry) KeyStore() (keystore.KeyStore, error) {
+	var ks keystore.KeyStore
+	for _, codec := range er.codecs {
+		kc, ok := codec.(KeyStoreCodec)
+		if !ok || kc.KeyStore() == nil {
+			continue
+		}
+		if ks != nil && ks != kc.KeyStore() {
+			return nil, ErrKeyStoreMismatch
+		}
+		ks = kc.KeyStore()
+	}
+	return ks, nil
+}
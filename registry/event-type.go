@@ -1,11 +1,77 @@
 package registry
 
+import (
+	"fmt"
+
+	validator "github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Upcaster turns a payload of a schema version into a payload of the next one.
+// Payloads are passed as generic values, map[string]interface{} for objects
+type Upcaster func(payload any) (any, error)
+
 type EventType struct {
 	Name      string
 	CodecName string
 	Init      func() *Event
+	// Version is the current payload schema version, 0 is the same as 1
+	Version int
+
+	upcasters map[int]Upcaster
+	// schema is the JSON Schema of the payloads, see SetSchema
+	schema   []byte
+	compiled *validator.Schema
 }
 
 func NewEventType(name string, codecName string, init func() *Event) *EventType {
 	return &EventType{Name: name, CodecName: codecName, Init: init}
 }
+
+// AddUpcaster sets the upcaster from schema version from to from+1, the event
+// type Version is raised to from+1 if lower
+func (et *EventType) AddUpcaster(from int, upcaster Upcaster) *EventType {
+	if et.upcasters == nil {
+		et.upcasters = make(map[int]Upcaster)
+	}
+	et.upcasters[from] = upcaster
+	if et.Version <= from {
+		et.Version = from + 1
+	}
+	return et
+}
+
+// CurrentVersion returns the current payload schema version
+func (et *EventType) CurrentVersion() int {
+	if et.Version == 0 {
+		return 1
+	}
+	return et.Version
+}
+
+// NeedsUpcast reports whether payloads of the given schema version must be upcasted
+func (et *EventType) NeedsUpcast(version int) bool {
+	if version == 0 {
+		version = 1
+	}
+	return version < et.CurrentVersion()
+}
+
+// Upcast runs the upcasters chain bringing payload from the given schema
+// version to the current one
+func (et *EventType) Upcast(version int, payload any) (any, error) {
+	if version == 0 {
+		version = 1
+	}
+	for v := version; v < et.CurrentVersion(); v++ {
+		upcaster, ok := et.upcasters[v]
+		if !ok {
+			return nil, fmt.Errorf("event type %s: no upcaster from version %d", et.Name, v)
+		}
+		var err error
+		payload, err = upcaster(payload)
+		if err != nil {
+			return nil, fmt.Errorf("event type %s: upcasting from version %d: %w", et.Name, v, err)
+		}
+	}
+	return payload, nil
+}
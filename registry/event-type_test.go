@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+type deviceUpdatedV3 struct {
+	Serial       string   `json:"serial"`
+	MACAddresses []string `json:"mac_addresses"`
+}
+
+func TestEventType_Upcast(t *testing.T) {
+	convey.Convey("Given an event type with an upcasters chain", t, func() {
+		et := NewEventType("device-updated", "JSON Codec", nil).
+			AddUpcaster(1, func(payload any) (any, error) {
+				p := payload.(map[string]interface{})
+				p["serial"] = p["serial_number"]
+				delete(p, "serial_number")
+				return p, nil
+			}).
+			AddUpcaster(2, func(payload any) (any, error) {
+				p := payload.(map[string]interface{})
+				p["mac_addresses"] = []interface{}{p["mac_address"]}
+				delete(p, "mac_address")
+				return p, nil
+			})
+
+		convey.Convey("The current version should follow the chain", func() {
+			assert.Equal(t, 3, et.CurrentVersion())
+			assert.True(t, et.NeedsUpcast(0))
+			assert.True(t, et.NeedsUpcast(2))
+			assert.False(t, et.NeedsUpcast(3))
+		})
+
+		convey.Convey("A version 1 payload should go through the whole chain", func() {
+			payload, err := et.Upcast(1, map[string]interface{}{"serial_number": "123", "mac_address": "00:00"})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, map[string]interface{}{"serial": "123", "mac_addresses": []interface{}{"00:00"}}, payload)
+		})
+
+		convey.Convey("A version 2 payload should skip the first step", func() {
+			payload, err := et.Upcast(2, map[string]interface{}{"serial": "123", "mac_address": "00:00"})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, map[string]interface{}{"serial": "123", "mac_addresses": []interface{}{"00:00"}}, payload)
+		})
+
+		convey.Convey("A failing upcaster should stop the chain", func() {
+			expectedErr := errors.New("bad payload")
+			et.AddUpcaster(1, func(payload any) (any, error) { return nil, expectedErr })
+			_, err := et.Upcast(1, map[string]interface{}{})
+			assert.ErrorIs(t, err, expectedErr)
+		})
+	})
+
+	convey.Convey("Given an event type with a gap in the chain", t, func() {
+		et := NewEventType("device-updated", "JSON Codec", nil)
+		et.Version = 2
+
+		convey.Convey("Upcasting should fail", func() {
+			_, err := et.Upcast(1, map[string]interface{}{})
+			assert.Error(t, err, "Expected an error")
+		})
+	})
+}
+
+func TestJsonCodec_Upcast(t *testing.T) {
+	convey.Convey("Given an event stored with the first payload schema", t, func() {
+		codec := NewJsonCodec(nil)
+		old := NewEventRegistry()
+		old.RegisterCodec(codec)
+		old.Register(NewEventType("device-updated", codec.Name(), func() *Event {
+			return &Event{Type: "device-updated", Timestamp: time.Now(), Meta: map[string]string{}}
+		}))
+		evt := old.NewEvent("device-updated")
+		evt.Payload = map[string]interface{}{"serial_number": "123", "mac_address": "00:00"}
+		data, _ := evt.Serialize()
+
+		convey.Convey("When the event type moved to version 3", func() {
+			er := NewEventRegistry()
+			er.RegisterCodec(codec)
+			et, _ := RegisterTyped[deviceUpdatedV3](er, "device-updated", codec)
+			et.AddUpcaster(1, func(payload any) (any, error) {
+				p := payload.(map[string]interface{})
+				return map[string]interface{}{"serial": p["serial_number"], "mac_address": p["mac_address"]}, nil
+			})
+			et.AddUpcaster(2, func(payload any) (any, error) {
+				p := payload.(map[string]interface{})
+				return map[string]interface{}{"serial": p["serial"], "mac_addresses": []interface{}{p["mac_address"]}}, nil
+			})
+
+			convey.Convey("Decoding should give the latest payload shape", func() {
+				target := er.NewEvent("device-updated")
+				err := target.Deserialize(data)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, 3, target.Version)
+				assert.Equal(t, deviceUpdatedV3{Serial: "123", MACAddresses: []string{"00:00"}}, target.Payload)
+			})
+
+			convey.Convey("New events should carry the current version", func() {
+				assert.Equal(t, 3, er.NewEvent("device-updated").Version)
+			})
+		})
+	})
+}
@@ -1,36 +1,128 @@
 package registry
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"time"
+
+	"github.com/lucacox/event-sourcing/keystore"
 )
 
+// ErrInvalidKey is returned when the payload encryption key is not an AES-256 key
+var ErrInvalidKey = keystore.ErrInvalidKey
+
 type Event struct {
 	Id        string            `json:"id"`
 	Timestamp time.Time         `json:"timestamp"`
 	EntityId  string            `json:"-"`
 	Type      string            `json:"type"`
 	Payload   any               `json:"payload"`
+	Version   int               `json:"version,omitempty"`
+	Encrypted bool              `json:"encrypted,omitempty"`
 	Meta      map[string]string `json:"meta"`
 	Sequence  uint64            `json:"-"`
 	Registry  *EventRegistry    `json:"-"`
+	// Redacted is set on decoded events whose payload could not be decrypted
+	// because the entity key was deleted
+	Redacted bool `json:"-"`
+}
+
+// Redact drops the event payload, used when it cannot be decrypted anymore
+func (e *Event) Redact() {
+	e.Payload = nil
+	e.Encrypted = false
+	e.Redacted = true
 }
 
+// EncryptPayload replaces the payload with its JSON encoding encrypted using
+// AES-256-GCM, the random nonce is prepended to the ciphertext. The event id
+// is authenticated too, so an encrypted payload cannot be moved to another event
 func (e *Event) EncryptPayload(key []byte) error {
-	// TODO: implement me
+	if e.Encrypted {
+		return nil
+	}
+	plaintext, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := e.seal(key, plaintext)
+	if err != nil {
+		return err
+	}
+	e.Payload = ciphertext
+	e.Encrypted = true
 	return nil
 }
 
+// DecryptPayload reverses EncryptPayload, the payload is decoded from JSON
 func (e *Event) DecryptPayload(key []byte) error {
-	// TODO: implement me
+	if !e.Encrypted {
+		return nil
+	}
+	plaintext, err := e.decrypt(key)
+	if err != nil {
+		return err
+	}
+	var payload any
+	err = json.Unmarshal(plaintext, &payload)
+	if err != nil {
+		return err
+	}
+	e.Payload = payload
+	e.Encrypted = false
 	return nil
 }
 
+// decrypt returns the plaintext of an encrypted payload
+func (e *Event) decrypt(key []byte) ([]byte, error) {
+	var data []byte
+	switch payload := e.Payload.(type) {
+	case []byte:
+		data = payload
+	case string:
+		// []byte payloads are base64 strings once decoded from JSON
+		var err error
+		data, err = base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("encrypted payload has unexpected type %T", e.Payload)
+	}
+	return e.open(key, data)
+}
+
+// seal encrypts plaintext with AES-256-GCM authenticating the event id, so an
+// encrypted payload cannot be moved to another event
+func (e *Event) seal(key []byte, plaintext []byte) ([]byte, error) {
+	return keystore.Seal(key, plaintext, []byte(e.Id))
+}
+
+// open reverses seal
+func (e *Event) open(key []byte, data []byte) ([]byte, error) {
+	return keystore.Open(key, data, []byte(e.Id))
+}
+
 func (e *Event) Serialize() ([]byte, error) {
 	evtType := e.Registry.GetType(e.Type)
 	codec := e.Registry.GetCodec(evtType.CodecName)
 	return codec.Encode(e)
 }
 
+// codec returns the codec of the event type
+func (e *Event) codec() (Codec, error) {
+	evtType := e.Registry.GetType(e.Type)
+	if evtType == nil {
+		return nil, fmt.Errorf("unknown event type %q", e.Type)
+	}
+	codec := e.Registry.GetCodec(evtType.CodecName)
+	if codec == nil {
+		return nil, fmt.Errorf("unknown codec %q", evtType.CodecName)
+	}
+	return codec, nil
+}
+
 func (e *Event) Deserialize(data []byte) error {
 	evtType := e.Registry.GetType(e.Type)
 	codec := e.Registry.GetCodec(evtType.CodecName)
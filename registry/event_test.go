@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvent_EncryptPayload(t *testing.T) {
+	convey.Convey("Given an event with a payload and an AES-256 key", t, func() {
+		key := bytes.Repeat([]byte{1}, 32)
+		evt := &Event{
+			Id:      "event-1",
+			Type:    "test-event",
+			Payload: map[string]interface{}{"owner": "John Doe"},
+		}
+
+		convey.Convey("When encrypting the payload", func() {
+			err := evt.EncryptPayload(key)
+
+			convey.Convey("The payload should be replaced by the ciphertext", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.True(t, evt.Encrypted, "Expected event to be marked as encrypted")
+				ciphertext, ok := evt.Payload.([]byte)
+				assert.True(t, ok, "Expected payload to be a byte slice")
+				assert.NotContains(t, string(ciphertext), "John Doe")
+			})
+
+			convey.Convey("Decrypting with the same key should restore the payload", func() {
+				err = evt.DecryptPayload(key)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.False(t, evt.Encrypted, "Expected event not to be marked as encrypted")
+				assert.Equal(t, map[string]interface{}{"owner": "John Doe"}, evt.Payload)
+			})
+
+			convey.Convey("Decrypting with another key should fail", func() {
+				err = evt.DecryptPayload(bytes.Repeat([]byte{2}, 32))
+				assert.Error(t, err, "Expected an error")
+				assert.True(t, evt.Encrypted, "Expected event to be still encrypted")
+			})
+
+			convey.Convey("Decrypting after moving the payload to another event should fail", func() {
+				other := &Event{Id: "event-2", Payload: evt.Payload, Encrypted: true}
+				err = other.DecryptPayload(key)
+				assert.Error(t, err, "Expected an error")
+			})
+		})
+
+		convey.Convey("When encrypting with a short key", func() {
+			err := evt.EncryptPayload([]byte("short"))
+
+			convey.Convey("An invalid key error should be returned", func() {
+				assert.ErrorIs(t, err, ErrInvalidKey)
+				assert.False(t, evt.Encrypted, "Expected event not to be marked as encrypted")
+			})
+		})
+	})
+}
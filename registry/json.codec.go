@@ -1,46 +1,57 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/lucacox/event-sourcing/keystore"
 )
 
 type JsonCodec struct {
-	ks keystore.KeyStore
+	payloadCodec
 }
 
+// NewJsonCodec creates a JSON codec, if ks is not nil payloads of entities
+// having a key in the store are encrypted
 func NewJsonCodec(ks keystore.KeyStore) *JsonCodec {
-	return &JsonCodec{ks: ks}
+	return &JsonCodec{payloadCodec{ks: ks, marshal: json.Marshal, unmarshal: json.Unmarshal}}
+}
+
+// SetMapPayloads makes Decode always return payloads as generic JSON values
+// (map[string]interface{} for objects) instead of the EventType payload type
+func (jc *JsonCodec) SetMapPayloads(enabled bool) {
+	jc.mapPayloads = enabled
 }
 
 func (jc *JsonCodec) Name() string {
 	return "JSON Codec"
 }
 
+// Decode fills target, whose Payload is expected to hold the prototype set by
+// EventType.Init: the payload is decoded into a new value of the same type.
+// Payloads stored with an old schema version are upcasted first.
+// A nil prototype gives a generic JSON value.
+// Decode expects target.EntityId to be already set when the payload is encrypted.
+// If the entity key was deleted the event is redacted instead of failing
 func (jc *JsonCodec) Decode(data []byte, target *Event) error {
-	err := json.Unmarshal(data, &target)
-	if jc.ks != nil {
-		key, err := jc.ks.GetKey(target.EntityId)
-		if err == nil && key != nil {
-			err = target.DecryptPayload(key)
-			if err != nil {
-				return err
-			}
-		}
+	prototype := target.Payload
+
+	type event Event
+	envelope := struct {
+		*event
+		Payload json.RawMessage `json:"payload"`
+	}{event: (*event)(target)}
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return err
 	}
-	return err
+	return jc.decodePayload(context.Background(), envelope.Payload, NoCompression, target, prototype)
 }
 
 func (jc *JsonCodec) Encode(e *Event) ([]byte, error) {
-	if jc.ks != nil {
-		key, err := jc.ks.GetKey(e.EntityId)
-		if err == nil && key != nil {
-			err = e.EncryptPayload(key)
-			if err != nil {
-				return nil, err
-			}
-		}
+	e, err := jc.encrypt(context.Background(), e)
+	if err != nil {
+		return nil, err
 	}
 	return json.Marshal(e)
 }
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+func TestJsonCodec_Encryption(t *testing.T) {
+	convey.Convey("Given a JSON codec with a key store holding a key for an entity", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+		codec := NewJsonCodec(ks)
+
+		evt := &Event{
+			Id:       "event-1",
+			EntityId: "entity-1",
+			Type:     "test-event",
+			Payload:  map[string]interface{}{"owner": "John Doe"},
+			Meta:     map[string]string{},
+		}
+
+		convey.Convey("When encoding an event of that entity", func() {
+			data, err := codec.Encode(evt)
+
+			convey.Convey("The serialized payload should be encrypted", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.NotContains(t, string(data), "John Doe")
+				assert.Contains(t, string(data), `"encrypted":true`)
+			})
+
+			convey.Convey("The caller event should keep its plain payload", func() {
+				assert.False(t, evt.Encrypted, "Expected event not to be marked as encrypted")
+				assert.Equal(t, map[string]interface{}{"owner": "John Doe"}, evt.Payload)
+			})
+
+			convey.Convey("Decoding should restore the plain payload", func() {
+				target := &Event{EntityId: "entity-1"}
+				err = codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.False(t, target.Encrypted, "Expected event not to be marked as encrypted")
+				assert.Equal(t, map[string]interface{}{"owner": "John Doe"}, target.Payload)
+			})
+		})
+
+		convey.Convey("When encoding an event of an entity without key", func() {
+			evt.EntityId = "entity-2"
+			data, err := codec.Encode(evt)
+
+			convey.Convey("The serialized payload should be in plain text", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Contains(t, string(data), "John Doe")
+				assert.NotContains(t, string(data), `"encrypted"`)
+			})
+		})
+
+		convey.Convey("When the key of the entity is deleted", func() {
+			data, _ := codec.Encode(evt)
+			ks.DeleteKey("entity-1")
+
+			convey.Convey("Its events should be decoded redacted", func() {
+				target := &Event{EntityId: "entity-1"}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.True(t, target.Redacted, "Expected event to be redacted")
+			})
+
+			convey.Convey("Its new events should not be encoded in plain text", func() {
+				_, err := codec.Encode(evt)
+				assert.ErrorIs(t, err, keystore.ErrKeyDeleted)
+			})
+		})
+
+		convey.Convey("When the key store does not know the key of the entity", func() {
+			data, _ := codec.Encode(evt)
+			other := NewJsonCodec(keystore.NewMemoryKeyStore())
+
+			convey.Convey("Its events should not be decoded", func() {
+				target := &Event{EntityId: "entity-1"}
+				err := other.Decode(data, target)
+				assert.ErrorIs(t, err, keystore.ErrKeyNotFound)
+				assert.False(t, target.Redacted, "Expected event not to be redacted")
+			})
+		})
+
+		convey.Convey("The registry should return the key store of the codec", func() {
+			er := NewEventRegistry()
+			er.RegisterCodec(codec)
+			er.RegisterCodec(NewCBORCodec(nil))
+			registered, err := er.KeyStore()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, ks, registered)
+
+			convey.Convey("And fail if codecs use different key stores", func() {
+				er.RegisterCodec(NewMsgpackCodec(keystore.NewMemoryKeyStore()))
+				_, err := er.KeyStore()
+				assert.ErrorIs(t, err, ErrKeyStoreMismatch)
+			})
+		})
+	})
+}
+
+type testDevicePayload struct {
+	Serial       string   `json:"serial"`
+	MACAddresses []string `json:"mac_addresses"`
+}
+
+func TestJsonCodec_TypedPayload(t *testing.T) {
+	convey.Convey("Given a JSON codec and an encoded event", t, func() {
+		codec := NewJsonCodec(nil)
+		data, _ := codec.Encode(&Event{
+			Id:      "event-1",
+			Type:    "test-event",
+			Payload: testDevicePayload{Serial: "123", MACAddresses: []string{"00:00:00:00:00:00"}},
+			Meta:    map[string]string{},
+		})
+		expected := testDevicePayload{Serial: "123", MACAddresses: []string{"00:00:00:00:00:00"}}
+
+		convey.Convey("Decoding into a target with a struct prototype should give a struct", func() {
+			target := &Event{Payload: testDevicePayload{}}
+			err := codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, expected, target.Payload)
+			assert.Equal(t, "event-1", target.Id)
+			assert.Equal(t, "test-event", target.Type)
+		})
+
+		convey.Convey("Decoding into a target with a pointer prototype should give a pointer", func() {
+			target := &Event{Payload: &testDevicePayload{}}
+			err := codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, &expected, target.Payload)
+		})
+
+		convey.Convey("Decoding into a target without prototype should give a map", func() {
+			target := &Event{}
+			err := codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.IsType(t, map[string]interface{}{}, target.Payload)
+		})
+
+		convey.Convey("Decoding with map payloads enabled should give a map", func() {
+			codec.SetMapPayloads(true)
+			target := &Event{Payload: testDevicePayload{}}
+			err := codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, "123", target.Payload.(map[string]interface{})["serial"])
+		})
+	})
+
+	convey.Convey("Given a JSON codec with a key store and an encrypted event", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+		codec := NewJsonCodec(ks)
+		data, _ := codec.Encode(&Event{
+			Id:       "event-1",
+			EntityId: "entity-1",
+			Payload:  testDevicePayload{Serial: "123"},
+		})
+
+		convey.Convey("Decoding should decrypt into the prototype type", func() {
+			target := &Event{EntityId: "entity-1", Payload: testDevicePayload{}}
+			err := codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.False(t, target.Encrypted, "Expected event not to be marked as encrypted")
+			assert.Equal(t, testDevicePayload{Serial: "123"}, target.Payload)
+		})
+	})
+}
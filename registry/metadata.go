@@ -0,0 +1,93 @@
+package registry
+
+import "context"
+
+// Standard Meta keys
+const (
+	// MetaCorrelationId is shared by all the events of a causal chain, it's the
+	// id of the event (or command) that started it
+	MetaCorrelationId = "correlation_id"
+	// MetaCausationId is the id of the event (or command) that produced the event
+	MetaCausationId = "causation_id"
+	// MetaActor is the user or service on whose behalf the event was produced
+	MetaActor = "actor"
+	// MetaTenant is the tenant the event belongs to
+	MetaTenant = "tenant"
+)
+
+// Metadata holds the standard metadata of an event, stored in its Meta
+type Metadata struct {
+	CorrelationId string
+	CausationId   string
+	Actor         string
+	Tenant        string
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying md, the EventStore sets it on the
+// events added with the returned context
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFrom returns the Metadata carried by ctx, empty if none
+func MetadataFrom(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// WithCause returns a copy of ctx for the events produced in reaction to evt:
+// they are caused by evt and inherit its correlation id, actor and tenant
+func WithCause(ctx context.Context, evt *Event) context.Context {
+	md := evt.Metadata()
+	if md.CorrelationId == "" {
+		md.CorrelationId = evt.Id
+	}
+	md.CausationId = evt.Id
+	return WithMetadata(ctx, md)
+}
+
+// Merge returns md with its empty fields taken from other
+func (md Metadata) Merge(other Metadata) Metadata {
+	if md.CorrelationId == "" {
+		md.CorrelationId = other.CorrelationId
+	}
+	if md.CausationId == "" {
+		md.CausationId = other.CausationId
+	}
+	if md.Actor == "" {
+		md.Actor = other.Actor
+	}
+	if md.Tenant == "" {
+		md.Tenant = other.Tenant
+	}
+	return md
+}
+
+// Metadata returns the standard metadata of the event
+func (e *Event) Metadata() Metadata {
+	return Metadata{
+		CorrelationId: e.Meta[MetaCorrelationId],
+		CausationId:   e.Meta[MetaCausationId],
+		Actor:         e.Meta[MetaActor],
+		Tenant:        e.Meta[MetaTenant],
+	}
+}
+
+// SetMetadata stores the non empty fields of md in the event Meta
+func (e *Event) SetMetadata(md Metadata) {
+	if e.Meta == nil {
+		e.Meta = map[string]string{}
+	}
+	for key, value := range map[string]string{
+		MetaCorrelationId: md.CorrelationId,
+		MetaCausationId:   md.CausationId,
+		MetaActor:         md.Actor,
+		MetaTenant:        md.Tenant,
+	} {
+		if value != "" {
+			e.Meta[key] = value
+		}
+	}
+}
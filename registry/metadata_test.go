@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata(t *testing.T) {
+	convey.Convey("Given a context with metadata", t, func() {
+		ctx := WithMetadata(context.Background(), Metadata{CorrelationId: "req-1", Actor: "john", Tenant: "acme"})
+
+		convey.Convey("It should be returned by MetadataFrom", func() {
+			md := MetadataFrom(ctx)
+			assert.Equal(t, Metadata{CorrelationId: "req-1", Actor: "john", Tenant: "acme"}, md)
+			assert.Equal(t, Metadata{}, MetadataFrom(context.Background()))
+		})
+
+		convey.Convey("Merge should keep the values already set", func() {
+			md := Metadata{Actor: "jane"}.Merge(MetadataFrom(ctx))
+			assert.Equal(t, Metadata{CorrelationId: "req-1", Actor: "jane", Tenant: "acme"}, md)
+		})
+	})
+
+	convey.Convey("Given an event with metadata", t, func() {
+		evt := &Event{Id: "evt-1"}
+		evt.SetMetadata(Metadata{CorrelationId: "req-1", Actor: "john"})
+
+		convey.Convey("It should be stored in Meta", func() {
+			assert.Equal(t, map[string]string{MetaCorrelationId: "req-1", MetaActor: "john"}, evt.Meta)
+			assert.Equal(t, Metadata{CorrelationId: "req-1", Actor: "john"}, evt.Metadata())
+		})
+
+		convey.Convey("WithCause should continue its chain", func() {
+			md := MetadataFrom(WithCause(context.Background(), evt))
+			assert.Equal(t, Metadata{CorrelationId: "req-1", CausationId: "evt-1", Actor: "john"}, md)
+		})
+
+		convey.Convey("WithCause on an event without correlation should root the chain on it", func() {
+			md := MetadataFrom(WithCause(context.Background(), &Event{Id: "evt-2"}))
+			assert.Equal(t, Metadata{CorrelationId: "evt-2", CausationId: "evt-2"}, md)
+		})
+	})
+}
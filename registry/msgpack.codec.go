@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/lucacox/event-sourcing/keystore"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec encodes events as MessagePack, with the same envelope and
+// payload field names of JsonCodec: struct fields use their json tags
+type MsgpackCodec struct {
+	payloadCodec
+}
+
+// NewMsgpackCodec creates a MessagePack codec, if ks is not nil payloads of
+// entities having a key in the store are encrypted
+func NewMsgpackCodec(ks keystore.KeyStore) *MsgpackCodec {
+	return &MsgpackCodec{payloadCodec{ks: ks, marshal: msgpackMarshal, unmarshal: msgpackUnmarshal}}
+}
+
+// SetMapPayloads makes Decode always return payloads as generic values
+// (map[string]interface{} for maps) instead of the EventType payload type
+func (mc *MsgpackCodec) SetMapPayloads(enabled bool) {
+	mc.mapPayloads = enabled
+}
+
+func (mc *MsgpackCodec) Name() string {
+	return "MessagePack Codec"
+}
+
+// Decode fills target as JsonCodec.Decode does. Generic values use int64,
+// uint64 and float64 for numbers
+func (mc *MsgpackCodec) Decode(data []byte, target *Event) error {
+	prototype := target.Payload
+
+	var raw rawEvent[msgpack.RawMessage]
+	err := msgpackUnmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	raw.fill(target)
+	return mc.decodePayload(context.Background(), raw.Payload, NoCompression, target, prototype)
+}
+
+func (mc *MsgpackCodec) Encode(e *Event) ([]byte, error) {
+	e, err := mc.encrypt(context.Background(), e)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackMarshal(e)
+}
+
+func msgpackMarshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func msgpackUnmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	return dec.Decode(v)
+}
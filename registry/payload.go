@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+// payloadCodec holds the payload logic shared by JSON, MessagePack and CBOR
+// codecs: encryption, upcasting and decoding into the prototype type
+type payloadCodec struct {
+	ks          keystore.KeyStore
+	mapPayloads bool
+	marshal     func(any) ([]byte, error)
+	unmarshal   func([]byte, any) error
+}
+
+// rawEvent is the decoded form of events whose payload is kept raw until its
+// type is known, R is the raw message type of the encoding
+type rawEvent[R any] struct {
+	Id        string            `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Type      string            `json:"type"`
+	Payload   R                 `json:"payload"`
+	Version   int               `json:"version,omitempty"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Meta      map[string]string `json:"meta"`
+}
+
+// fill copies the event fields, except the payload, to target
+func (re *rawEvent[R]) fill(target *Event) {
+	target.Id = re.Id
+	target.Timestamp = re.Timestamp
+	target.Type = re.Type
+	target.Version = re.Version
+	target.Encrypted = re.Encrypted
+	if re.Meta != nil {
+		target.Meta = re.Meta
+	}
+}
+
+// encrypt returns the event to encode: e itself or, if its entity has a key,
+// a copy with the encoded payload encrypted, the caller event keeps its plain payload
+func (pc *payloadCodec) encrypt(ctx context.Context, e *Event) (*Event, error) {
+	if pc.ks == nil || e.Encrypted {
+		return e, nil
+	}
+	key, err := encryptionKey(ctx, pc.ks, e)
+	if err != nil || key == nil {
+		return e, err
+	}
+	plaintext, err := pc.marshal(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := e.seal(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := *e
+	encrypted.Payload = ciphertext
+	encrypted.Encrypted = true
+	return &encrypted, nil
+}
+
+// EncodePayload encodes the payload alone, encrypted if the entity has a key.
+// Encrypted payloads are stored as a byte string
+func (pc *payloadCodec) EncodePayload(ctx context.Context, e *Event, env *Envelope) ([]byte, error) {
+	return pc.encodeCompressed(ctx, e, env, NoCompression, 0)
+}
+
+// encodeCompressed encodes the payload alone, compressed with algorithm if it is
+// at least threshold bytes long and then encrypted if the entity has a key.
+// Compressed or encrypted payloads are stored as a byte string
+func (pc *payloadCodec) encodeCompressed(ctx context.Context, e *Event, env *Envelope, algorithm Compression, threshold int) ([]byte, error) {
+	data, err := pc.marshal(e.Payload)
+	if err != nil || e.Encrypted {
+		env.Encrypted = e.Encrypted
+		return data, err
+	}
+	data, env.Compression, err = compress(data, algorithm, threshold)
+	if err != nil {
+		return nil, err
+	}
+	if pc.ks != nil {
+		key, err := encryptionKey(ctx, pc.ks, e)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			data, err = e.seal(key, data)
+			if err != nil {
+				return nil, err
+			}
+			env.Encrypted = true
+		}
+	}
+	if env.Encrypted || env.Compression != NoCompression {
+		return pc.marshal(data)
+	}
+	return data, nil
+}
+
+// DecodePayload decodes a payload encoded by EncodePayload into a new value of
+// the target prototype type, decrypting, decompressing and upcasting it if needed
+func (pc *payloadCodec) DecodePayload(ctx context.Context, env *Envelope, data []byte, target *Event) error {
+	return pc.decodePayload(ctx, data, env.Compression, target, target.Payload)
+}
+
+// decodePayload sets the target payload from its raw encoding, decrypting,
+// decompressing and upcasting it if needed. If the entity key was deleted the
+// event is redacted
+func (pc *payloadCodec) decodePayload(ctx context.Context, raw []byte, compression Compression, target *Event, prototype any) error {
+	var key []byte
+	if target.Encrypted {
+		var err error
+		key, err = decryptionKey(ctx, pc.ks, target)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			target.Redact()
+			return nil
+		}
+	}
+	if target.Encrypted || compression != NoCompression {
+		var data []byte
+		err := pc.unmarshal(raw, &data)
+		if err != nil {
+			return err
+		}
+		if target.Encrypted {
+			data, err = target.open(key, data)
+			if err != nil {
+				return err
+			}
+			target.Encrypted = false
+		}
+		raw, err = decompress(data, compression)
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, err := pc.upcast(raw, target)
+	if err != nil {
+		return err
+	}
+
+	if pc.mapPayloads {
+		prototype = nil
+	}
+	target.Payload, err = pc.decodeAs(raw, prototype)
+	return err
+}
+
+// encryptionKey returns the key encrypting the payload of e, nil if its entity
+// has none. Entities forgotten by deleting their key cannot get new events
+func encryptionKey(ctx context.Context, ks keystore.KeyStore, e *Event) ([]byte, error) {
+	key, err := keystore.CachedKey(ctx, ks, e.EntityId)
+	switch {
+	case errors.Is(err, keystore.ErrKeyNotFound):
+		return nil, nil
+	case errors.Is(err, keystore.ErrKeyDeleted):
+		return nil, fmt.Errorf("cannot encode event %s: entity %s was forgotten: %w", e.Id, e.EntityId, err)
+	}
+	return key, err
+}
+
+// decryptionKey returns the key decrypting the payload of e, nil if it was deleted
+// because the entity was forgotten. A key never stored is an error, as the payload
+// was encrypted with a key the key store does not know
+func decryptionKey(ctx context.Context, ks keystore.KeyStore, e *Event) ([]byte, error) {
+	if ks == nil {
+		return nil, fmt.Errorf("cannot decrypt payload of event %s: no key store", e.Id)
+	}
+	key, err := keystore.CachedKey(ctx, ks, e.EntityId)
+	switch {
+	case errors.Is(err, keystore.ErrKeyDeleted):
+		return nil, nil
+	case errors.Is(err, keystore.ErrKeyNotFound):
+		return nil, fmt.Errorf("cannot decrypt payload of event %s: %w", e.Id, err)
+	}
+	return key, err
+}
+
+// KeyStore returns the KeyStore holding the keys of the encrypted payloads, nil if
+// payloads are not encrypted
+func (pc *payloadCodec) KeyStore() keystore.KeyStore {
+	return pc.ks
+}
+
+// upcast brings a payload stored with an old schema version to the current
+// one, updating the target version
+func (pc *payloadCodec) upcast(raw []byte, target *Event) ([]byte, error) {
+	if target.Registry == nil {
+		return raw, nil
+	}
+	et := target.Registry.GetType(target.Type)
+	if et == nil || !et.NeedsUpcast(target.Version) {
+		return raw, nil
+	}
+	payload, err := pc.decodeAs(raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = et.Upcast(target.Version, payload)
+	if err != nil {
+		return nil, err
+	}
+	target.Version = et.CurrentVersion()
+	return pc.marshal(payload)
+}
+
+// decodeAs decodes raw into a new value of the prototype type, keeping
+// pointers as pointers. A nil prototype gives a generic value
+func (pc *payloadCodec) decodeAs(raw []byte, prototype any) (any, error) {
+	if len(raw) == 0 {
+		return prototype, nil
+	}
+	if prototype == nil {
+		var payload any
+		err := pc.unmarshal(raw, &payload)
+		return payload, err
+	}
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Pointer {
+		payload := reflect.New(t.Elem())
+		err := pc.unmarshal(raw, payload.Interface())
+		return payload.Interface(), err
+	}
+	payload := reflect.New(t)
+	err := pc.unmarshal(raw, payload.Interface())
+	return payload.Elem().Interface(), err
+}
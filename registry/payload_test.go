@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+// binary codecs share the JsonCodec envelope semantics
+func TestBinaryCodecs(t *testing.T) {
+	codecs := map[string]func(keystore.KeyStore) Codec{
+		"MessagePack": func(ks keystore.KeyStore) Codec { return NewMsgpackCodec(ks) },
+		"CBOR":        func(ks keystore.KeyStore) Codec { return NewCBORCodec(ks) },
+	}
+	for name, newCodec := range codecs {
+		convey.Convey("Given a "+name+" codec and an encoded event", t, func() {
+			codec := newCodec(nil)
+			evt := &Event{
+				Id:        "event-1",
+				Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 123, time.UTC),
+				Type:      "test-event",
+				Payload:   testDevicePayload{Serial: "123", MACAddresses: []string{"00:00:00:00:00:00"}},
+				Version:   1,
+				Meta:      map[string]string{"correlation_id": "c-1"},
+			}
+			data, err := codec.Encode(evt)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			convey.Convey("Decoding should restore the envelope fields", func() {
+				target := &Event{Payload: testDevicePayload{}}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, "event-1", target.Id)
+				assert.Equal(t, "test-event", target.Type)
+				assert.Equal(t, 1, target.Version)
+				assert.True(t, evt.Timestamp.Equal(target.Timestamp), "Expected timestamp %s, but got %s", evt.Timestamp, target.Timestamp)
+				assert.Equal(t, evt.Meta, target.Meta)
+				assert.Equal(t, evt.Payload, target.Payload)
+			})
+
+			convey.Convey("Decoding into a target with a pointer prototype should give a pointer", func() {
+				target := &Event{Payload: &testDevicePayload{}}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, &testDevicePayload{Serial: "123", MACAddresses: []string{"00:00:00:00:00:00"}}, target.Payload)
+			})
+
+			convey.Convey("Decoding into a target without prototype should use the json field names", func() {
+				target := &Event{}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, "123", target.Payload.(map[string]interface{})["serial"])
+			})
+		})
+
+		convey.Convey("Given a "+name+" codec with a key store holding a key for an entity", t, func() {
+			ks := keystore.NewMemoryKeyStore()
+			ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+			codec := newCodec(ks)
+			evt := &Event{
+				Id:       "event-1",
+				EntityId: "entity-1",
+				Type:     "test-event",
+				Payload:  testDevicePayload{Serial: "John Doe"},
+				Meta:     map[string]string{},
+			}
+			data, err := codec.Encode(evt)
+
+			convey.Convey("The serialized payload should be encrypted", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.NotContains(t, string(data), "John Doe")
+				assert.False(t, evt.Encrypted, "Expected the caller event not to be marked as encrypted")
+			})
+
+			convey.Convey("Decoding should decrypt into the prototype type", func() {
+				target := &Event{EntityId: "entity-1", Payload: testDevicePayload{}}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.False(t, target.Encrypted, "Expected event not to be marked as encrypted")
+				assert.Equal(t, testDevicePayload{Serial: "John Doe"}, target.Payload)
+			})
+
+			convey.Convey("Decoding after the key is deleted should redact the event", func() {
+				ks.DeleteKey("entity-1")
+				target := &Event{EntityId: "entity-1", Payload: testDevicePayload{}}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.True(t, target.Redacted, "Expected event to be redacted")
+			})
+
+			convey.Convey("Decoding with a key store without the key should fail", func() {
+				target := &Event{EntityId: "entity-1", Payload: testDevicePayload{}}
+				err := newCodec(keystore.NewMemoryKeyStore()).Decode(data, target)
+				assert.ErrorIs(t, err, keystore.ErrKeyNotFound)
+				assert.False(t, target.Redacted, "Expected event not to be redacted")
+			})
+		})
+
+		convey.Convey("Given an event stored by a "+name+" codec with the first payload schema", t, func() {
+			codec := newCodec(nil)
+			data, _ := codec.Encode(&Event{
+				Id:      "event-1",
+				Type:    "device-updated",
+				Payload: map[string]interface{}{"serial_number": "123", "mac_address": "00:00"},
+				Version: 1,
+			})
+
+			convey.Convey("Decoding with a version 2 event type should upcast the payload", func() {
+				er := NewEventRegistry()
+				et, _ := RegisterTyped[deviceUpdatedV3](er, "device-updated", codec)
+				et.AddUpcaster(1, func(payload any) (any, error) {
+					p := payload.(map[string]interface{})
+					return map[string]interface{}{"serial": p["serial_number"], "mac_addresses": []interface{}{p["mac_address"]}}, nil
+				})
+				target := er.NewEvent("device-updated")
+				err := target.Deserialize(data)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, 2, target.Version)
+				assert.Equal(t, deviceUpdatedV3{Serial: "123", MACAddresses: []string{"00:00"}}, target.Payload)
+			})
+		})
+	}
+}
+
+func TestCBORCodec_RawPayload(t *testing.T) {
+	convey.Convey("Given a payload already encoded as CBOR", t, func() {
+		codec := NewCBORCodec(nil)
+		raw, _ := cbor.Marshal(map[string]interface{}{"temperature": 21})
+
+		convey.Convey("It should be stored as is and decoded into the prototype", func() {
+			data, err := codec.Encode(&Event{Id: "event-1", Type: "sample", Payload: cbor.RawMessage(raw)})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.True(t, bytes.Contains(data, raw), "Expected the raw payload in the encoded event")
+
+			target := &Event{Payload: cbor.RawMessage(nil)}
+			err = codec.Decode(data, target)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, cbor.RawMessage(raw), target.Payload)
+		})
+	})
+}
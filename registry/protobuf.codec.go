@@ -0,0 +1,317 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/lucacox/event-sourcing/keystore"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const typeURLPrefix = "type.googleapis.com/"
+
+// envelope field numbers, the encoding is the one of the message
+//
+//	message Envelope {
+//	  string id = 1;
+//	  google.protobuf.Timestamp timestamp = 2;
+//	  string type = 3;
+//	  google.protobuf.Any payload = 4;
+//	  int32 version = 5;
+//	  bool encrypted = 6;
+//	  map<string, string> meta = 7;
+//	}
+const (
+	envelopeId protowire.Number = iota + 1
+	envelopeTimestamp
+	envelopeType
+	envelopePayload
+	envelopeVersion
+	envelopeEncrypted
+	envelopeMeta
+)
+
+// ProtobufCodec encodes events whose payload is a proto.Message, the payload
+// is wrapped in a google.protobuf.Any so its type URL is stored with the event
+type ProtobufCodec struct {
+	ks keystore.KeyStore
+}
+
+// NewProtobufCodec creates a Protocol Buffers codec, if ks is not nil payloads
+// of entities having a key in the store are encrypted
+func NewProtobufCodec(ks keystore.KeyStore) *ProtobufCodec {
+	return &ProtobufCodec{ks: ks}
+}
+
+func (pc *ProtobufCodec) Name() string {
+	return "Protobuf Codec"
+}
+
+// KeyStore returns the KeyStore holding the keys of the encrypted payloads, nil if
+// payloads are not encrypted
+func (pc *ProtobufCodec) KeyStore() keystore.KeyStore {
+	return pc.ks
+}
+
+// Header returns the codec name along with the payload type URL
+func (pc *ProtobufCodec) Header(e *Event) string {
+	msg, ok := e.Payload.(proto.Message)
+	if !ok {
+		return pc.Name()
+	}
+	return pc.Name() + "; type=" + typeURL(msg)
+}
+
+func (pc *ProtobufCodec) Encode(e *Event) ([]byte, error) {
+	// the envelope encoding has no compression field
+	env := &Envelope{}
+	payload, err := pc.encodeCompressed(context.Background(), e, env, NoCompression, 0)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := proto.Marshal(timestamppb.New(e.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = appendString(b, envelopeId, e.Id)
+	b = appendBytes(b, envelopeTimestamp, timestamp)
+	b = appendString(b, envelopeType, e.Type)
+	b = appendBytes(b, envelopePayload, payload)
+	if e.Version != 0 {
+		b = protowire.AppendTag(b, envelopeVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Version))
+	}
+	if env.Encrypted {
+		b = protowire.AppendTag(b, envelopeEncrypted, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	keys := make([]string, 0, len(e.Meta))
+	for k := range e.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, e.Meta[k])
+		b = appendBytes(b, envelopeMeta, entry)
+	}
+	return b, nil
+}
+
+// Decode fills target, whose Payload is expected to hold the proto.Message
+// prototype set by EventType.Init: the payload is decoded into a new message
+// of the same type, failing if the stored type URL is a different one. A nil
+// prototype resolves the message type from the global protobuf registry.
+// Upcasters are not run, protobuf schemas are expected to evolve compatibly.
+// Decode expects target.EntityId to be already set when the payload is encrypted.
+// If the entity key was deleted the event is redacted instead of failing
+func (pc *ProtobufCodec) Decode(data []byte, target *Event) error {
+	prototype := target.Payload
+
+	payload := &anypb.Any{}
+	target.Meta = map[string]string{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch {
+		case num == envelopeId && typ == protowire.BytesType:
+			target.Id, n = consumeString(data)
+		case num == envelopeTimestamp && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				ts := &timestamppb.Timestamp{}
+				if err := proto.Unmarshal(v, ts); err != nil {
+					return err
+				}
+				target.Timestamp = ts.AsTime()
+			}
+		case num == envelopeType && typ == protowire.BytesType:
+			target.Type, n = consumeString(data)
+		case num == envelopePayload && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				if err := proto.Unmarshal(v, payload); err != nil {
+					return err
+				}
+			}
+		case num == envelopeVersion && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			target.Version = int(int32(v))
+		case num == envelopeEncrypted && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			target.Encrypted = v != 0
+		case num == envelopeMeta && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				k, value, err := consumeMetaEntry(v)
+				if err != nil {
+					return err
+				}
+				target.Meta[k] = value
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+
+	return pc.decodeAny(context.Background(), payload, NoCompression, target, prototype)
+}
+
+// EncodePayload encodes the payload alone as a google.protobuf.Any, encrypting
+// the message if the entity has a key
+func (pc *ProtobufCodec) EncodePayload(ctx context.Context, e *Event, env *Envelope) ([]byte, error) {
+	return pc.encodeCompressed(ctx, e, env, NoCompression, 0)
+}
+
+// encodeCompressed is like EncodePayload, compressing the message with algorithm
+// before encrypting it if it is at least threshold bytes long
+func (pc *ProtobufCodec) encodeCompressed(ctx context.Context, e *Event, env *Envelope, algorithm Compression, threshold int) ([]byte, error) {
+	msg, ok := e.Payload.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not a proto.Message", ErrPayloadType, e.Payload)
+	}
+	value, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	value, env.Compression, err = compress(value, algorithm, threshold)
+	if err != nil {
+		return nil, err
+	}
+	if pc.ks != nil {
+		key, err := encryptionKey(ctx, pc.ks, e)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			// the type URL stays in clear, only the message is encrypted
+			value, err = e.seal(key, value)
+			if err != nil {
+				return nil, err
+			}
+			env.Encrypted = true
+		}
+	}
+	return proto.Marshal(&anypb.Any{TypeUrl: typeURL(msg), Value: value})
+}
+
+// DecodePayload decodes a payload encoded by EncodePayload as Decode does
+func (pc *ProtobufCodec) DecodePayload(ctx context.Context, env *Envelope, data []byte, target *Event) error {
+	payload := &anypb.Any{}
+	err := proto.Unmarshal(data, payload)
+	if err != nil {
+		return err
+	}
+	return pc.decodeAny(ctx, payload, env.Compression, target, target.Payload)
+}
+
+// decodeAny sets the target payload to the message held by payload
+func (pc *ProtobufCodec) decodeAny(ctx context.Context, payload *anypb.Any, compression Compression, target *Event, prototype any) error {
+	value := payload.Value
+	if target.Encrypted {
+		key, err := decryptionKey(ctx, pc.ks, target)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			target.Redact()
+			return nil
+		}
+		value, err = target.open(key, value)
+		if err != nil {
+			return err
+		}
+		target.Encrypted = false
+	}
+	value, err := decompress(value, compression)
+	if err != nil {
+		return err
+	}
+
+	var msg proto.Message
+	if p, ok := prototype.(proto.Message); ok {
+		if url := typeURL(p); url != payload.TypeUrl {
+			return fmt.Errorf("%w: event %s has payload %s, expected %s", ErrPayloadType, target.Id, payload.TypeUrl, url)
+		}
+		msg = p.ProtoReflect().New().Interface()
+	} else {
+		mt, err := protoregistry.GlobalTypes.FindMessageByURL(payload.TypeUrl)
+		if err != nil {
+			return fmt.Errorf("cannot decode payload of event %s: %w", target.Id, err)
+		}
+		msg = mt.New().Interface()
+	}
+	err = proto.Unmarshal(value, msg)
+	if err != nil {
+		return err
+	}
+	target.Payload = msg
+	return nil
+}
+
+func typeURL(msg proto.Message) string {
+	return typeURLPrefix + string(msg.ProtoReflect().Descriptor().FullName())
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func consumeString(b []byte) (string, int) {
+	v, n := protowire.ConsumeBytes(b)
+	return string(v), n
+}
+
+// consumeMetaEntry decodes a map<string, string> entry
+func consumeMetaEntry(b []byte) (string, string, error) {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = consumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = consumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
@@ -0,0 +1,131 @@
+package registry
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/lucacox/event-sourcing/keystore"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	convey.Convey("Given a Protobuf codec and an event type with a proto.Message payload", t, func() {
+		er := NewEventRegistry()
+		codec := NewProtobufCodec(nil)
+		_, err := RegisterTyped[*wrapperspb.StringValue](er, "test-event", codec)
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+
+		evt, _ := NewTypedEvent(er, wrapperspb.String("hello"))
+		evt.Timestamp = time.Date(2024, 5, 1, 10, 0, 0, 123, time.UTC)
+		evt.Meta["correlation_id"] = "c-1"
+
+		convey.Convey("The codec header should carry the payload type URL", func() {
+			name, params := ParseCodecHeader(CodecHeader(codec, evt))
+			assert.Equal(t, "Protobuf Codec", name)
+			assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", params["type"])
+		})
+
+		convey.Convey("When encoding and decoding the event", func() {
+			data, err := codec.Encode(evt)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			target := er.NewEvent("test-event")
+			err = codec.Decode(data, target)
+
+			convey.Convey("The event should be restored with a typed payload", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, evt.Id, target.Id)
+				assert.Equal(t, "test-event", target.Type)
+				assert.True(t, evt.Timestamp.Equal(target.Timestamp), "Expected timestamp %s, but got %s", evt.Timestamp, target.Timestamp)
+				assert.Equal(t, 1, target.Version)
+				assert.Equal(t, map[string]string{"correlation_id": "c-1"}, target.Meta)
+				payload, ok := target.Payload.(*wrapperspb.StringValue)
+				assert.True(t, ok, "Expected a *wrapperspb.StringValue payload, but got %T", target.Payload)
+				assert.True(t, proto.Equal(wrapperspb.String("hello"), payload), "Unexpected payload %v", payload)
+			})
+
+			convey.Convey("A nil prototype should resolve the type from the protobuf registry", func() {
+				target := &Event{}
+				err := codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.IsType(t, &wrapperspb.StringValue{}, target.Payload)
+			})
+
+			convey.Convey("A prototype of another message type should fail", func() {
+				target := &Event{Payload: &structpb.Struct{}}
+				err := codec.Decode(data, target)
+				assert.ErrorIs(t, err, ErrPayloadType)
+			})
+		})
+
+		convey.Convey("Encoding a payload that is not a proto.Message should fail", func() {
+			_, err := codec.Encode(&Event{Id: "event-1", Payload: map[string]interface{}{}})
+			assert.ErrorIs(t, err, ErrPayloadType)
+		})
+	})
+}
+
+func TestProtobufCodec_Encryption(t *testing.T) {
+	convey.Convey("Given a Protobuf codec with a key store holding a key for an entity", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		ks.SetKey("entity-1", bytes.Repeat([]byte{1}, 32))
+		codec := NewProtobufCodec(ks)
+
+		evt := &Event{
+			Id:       "event-1",
+			EntityId: "entity-1",
+			Type:     "test-event",
+			Payload:  wrapperspb.String("John Doe"),
+			Meta:     map[string]string{},
+		}
+
+		convey.Convey("When encoding an event of that entity", func() {
+			data, err := codec.Encode(evt)
+
+			convey.Convey("The payload should be encrypted but its type visible", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.NotContains(t, string(data), "John Doe")
+				assert.Contains(t, string(data), "google.protobuf.StringValue")
+			})
+
+			convey.Convey("Decoding should restore the plain payload", func() {
+				target := &Event{EntityId: "entity-1", Payload: (*wrapperspb.StringValue)(nil)}
+				err = codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.False(t, target.Encrypted, "Expected event not to be marked as encrypted")
+				assert.Equal(t, "John Doe", target.Payload.(*wrapperspb.StringValue).GetValue())
+			})
+
+			convey.Convey("Decoding after the key is deleted should redact the event", func() {
+				ks.DeleteKey("entity-1")
+				target := &Event{EntityId: "entity-1", Payload: (*wrapperspb.StringValue)(nil)}
+				err = codec.Decode(data, target)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.True(t, target.Redacted, "Expected event to be redacted")
+				assert.Nil(t, target.Payload)
+			})
+		})
+	})
+}
+
+func TestParseCodecHeader(t *testing.T) {
+	convey.Convey("Given codec headers with and without parameters", t, func() {
+		convey.Convey("A plain codec name should have no parameters", func() {
+			name, params := ParseCodecHeader("JSON Codec")
+			assert.Equal(t, "JSON Codec", name)
+			assert.Empty(t, params)
+		})
+
+		convey.Convey("Parameters should be split from the name", func() {
+			name, params := ParseCodecHeader("Protobuf Codec; type=type.googleapis.com/a.B; x=1")
+			assert.Equal(t, "Protobuf Codec", name)
+			assert.Equal(t, map[string]string{"type": "type.googleapis.com/a.B", "x": "1"}, params)
+		})
+	})
+}
@@ -0,0 +1,252 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+	validator "github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrInvalidPayload is matched by ValidationError with errors.Is
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// FieldError is a payload field failing validation
+type FieldError struct {
+	// Field is the JSON pointer of the field, e.g. /mac_addresses/0, empty
+	// for the payload itself
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when an event payload does not match the JSON
+// Schema of its type, it lists the failing fields
+type ValidationError struct {
+	EventType string       `json:"event_type"`
+	EventId   string       `json:"event_id"`
+	Fields    []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		field := f.Field
+		if field == "" {
+			field = "payload"
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", field, f.Message))
+	}
+	return fmt.Sprintf("invalid payload of event %s (%s): %s", e.EventId, e.EventType, strings.Join(fields, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidPayload
+}
+
+// SetSchema sets the JSON Schema validating the payloads of the event type,
+// any draft up to 2020-12 can be used
+func (et *EventType) SetSchema(schema []byte) error {
+	compiler := validator.NewCompiler()
+	url := "event-type:" + et.Name
+	err := compiler.AddResource(url, bytes.NewReader(schema))
+	if err != nil {
+		return err
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return err
+	}
+	et.schema = schema
+	et.compiled = compiled
+	return nil
+}
+
+// GenerateSchema sets a JSON Schema generated from the payload prototype set
+// by Init: properties are named after the json tags, fields without omitempty
+// are required and unknown properties are rejected. Slices, maps and pointers
+// accept null, that is how nil values are encoded. Constraints can be added
+// with jsonschema tags, e.g. `jsonschema:"minLength=1,pattern=^[0-9]+$"`
+func (et *EventType) GenerateSchema() error {
+	var prototype any
+	if et.Init != nil {
+		prototype = et.Init().Payload
+	}
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		return fmt.Errorf("event type %s has no payload prototype", et.Name)
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// the root type is referenced from $defs, like the other structs, so that
+	// recursive types resolve
+	reflector := &jsonschema.Reflector{Anonymous: true}
+	data, err := json.Marshal(reflector.ReflectFromType(t))
+	if err != nil {
+		return err
+	}
+	var schema map[string]any
+	err = json.Unmarshal(data, &schema)
+	if err != nil {
+		return err
+	}
+	defs, _ := schema["$defs"].(map[string]any)
+	allowNull(schema, t, defs, map[reflect.Type]bool{})
+	data, err = json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	return et.SetSchema(data)
+}
+
+// allowNull makes s, the generated schema of t, accept null wherever t holds
+// a slice, a map or a pointer
+func allowNull(s map[string]any, t reflect.Type, defs map[string]any, seen map[reflect.Type]bool) {
+	if ref, ok := s["$ref"].(string); ok {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		s, _ = defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+		if s == nil {
+			return
+		}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if items, ok := s["items"].(map[string]any); ok {
+			allowNull(items, t.Elem(), defs, seen)
+			s["items"] = nullable(items, t.Elem())
+		}
+	case reflect.Map:
+		if values, ok := s["additionalProperties"].(map[string]any); ok {
+			allowNull(values, t.Elem(), defs, seen)
+			s["additionalProperties"] = nullable(values, t.Elem())
+		}
+	case reflect.Struct:
+		if properties, ok := s["properties"].(map[string]any); ok {
+			allowNullFields(properties, t, defs, seen)
+		}
+	}
+}
+
+// allowNullFields applies allowNull to the properties of the fields of struct t,
+// following the encoding/json rules for names and embedded structs
+func allowNullFields(properties map[string]any, t reflect.Type, defs map[string]any, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				allowNullFields(properties, ft, defs, seen)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		property, ok := properties[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		allowNull(property, f.Type, defs, seen)
+		properties[name] = nullable(property, f.Type)
+	}
+}
+
+// nullable returns s accepting null too if values of type t can be nil
+func nullable(s map[string]any, t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map:
+	default:
+		return s
+	}
+	_, enum := s["enum"]
+	_, constant := s["const"]
+	if typ, ok := s["type"].(string); ok && !enum && !constant {
+		s["type"] = []any{typ, "null"}
+		return s
+	}
+	return map[string]any{"anyOf": []any{s, map[string]any{"type": "null"}}}
+}
+
+// Schema returns the JSON Schema of the event type, nil if not set
+func (et *EventType) Schema() []byte {
+	return et.schema
+}
+
+// Validate checks the event payload against the schema of the event type,
+// returning a *ValidationError if it does not match. Events are valid if the
+// type has no schema, encrypted payloads are not checked
+func (et *EventType) Validate(e *Event) error {
+	if et.compiled == nil || e.Encrypted {
+		return nil
+	}
+	data, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	// numbers are kept as json.Number so that integers are checked exactly
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var payload any
+	err = dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	err = et.compiled.Validate(payload)
+	var ve *validator.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	return &ValidationError{EventType: et.Name, EventId: e.Id, Fields: fieldErrors(ve, nil)}
+}
+
+// fieldErrors appends to fields the leaves of the validation errors tree
+func fieldErrors(ve *validator.ValidationError, fields []FieldError) []FieldError {
+	if len(ve.Causes) > 0 {
+		for _, cause := range ve.Causes {
+			// the null alternative of a nullable property is not a field error
+			if len(cause.Causes) == 0 && strings.HasSuffix(ve.KeywordLocation, "/anyOf") && strings.HasPrefix(cause.Message, "expected null") {
+				continue
+			}
+			fields = fieldErrors(cause, fields)
+		}
+		return fields
+	}
+	// missing and unknown properties are reported once on the parent object,
+	// e.g. missing properties: 'serial', 'mac_addresses'
+	switch {
+	case strings.HasSuffix(ve.KeywordLocation, "/required"):
+		if names, ok := strings.CutPrefix(ve.Message, "missing properties: "); ok {
+			return propertyErrors(fields, ve.InstanceLocation, names, "missing property")
+		}
+	case strings.HasSuffix(ve.KeywordLocation, "/additionalProperties"):
+		names, ok := strings.CutPrefix(ve.Message, "additionalProperties ")
+		if names, found := strings.CutSuffix(names, " not allowed"); ok && found {
+			return propertyErrors(fields, ve.InstanceLocation, names, "property not allowed")
+		}
+	}
+	return append(fields, FieldError{Field: ve.InstanceLocation, Message: ve.Message})
+}
+
+// propertyErrors appends an error for each of the quoted, comma separated,
+// property names of the object at location
+func propertyErrors(fields []FieldError, location string, names string, message string) []FieldError {
+	for _, name := range strings.Split(names, ", ") {
+		fields = append(fields, FieldError{Field: location + "/" + strings.Trim(name, "'"), Message: message})
+	}
+	return fields
+}
@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSensorPayload struct {
+	Serial    string             `json:"serial" jsonschema:"minLength=1"`
+	Readings  []int              `json:"readings" jsonschema:"maxItems=2"`
+	Threshold *float64           `json:"threshold,omitempty" jsonschema:"minimum=0"`
+	Location  *testSensorPlace   `json:"location"`
+	Labels    map[string]*string `json:"labels"`
+}
+
+type testSensorPlace struct {
+	Room string `json:"room" jsonschema:"minLength=1"`
+}
+
+// testTreeNode is a recursive payload type
+type testTreeNode struct {
+	Name     string          `json:"name" jsonschema:"minLength=1"`
+	Parent   *testTreeNode   `json:"parent"`
+	Children []*testTreeNode `json:"children"`
+}
+
+func TestEventType_GenerateSchema(t *testing.T) {
+	convey.Convey("Given an event type with a schema generated from its payload struct", t, func() {
+		er := NewEventRegistry()
+		et, _ := RegisterTyped[testSensorPayload](er, "sensor-read", NewJsonCodec(nil))
+		err := et.GenerateSchema()
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+		assert.Contains(t, string(et.Schema()), `"serial"`)
+
+		convey.Convey("A valid payload should pass", func() {
+			evt, _ := NewTypedEvent(er, testSensorPayload{Serial: "123", Readings: []int{1}})
+			assert.NoError(t, et.Validate(evt))
+		})
+
+		convey.Convey("Nil slices, maps and pointers should be valid", func() {
+			evt, _ := NewTypedEvent(er, testSensorPayload{Serial: "123", Labels: map[string]*string{"floor": nil}})
+			assert.NoError(t, et.Validate(evt))
+		})
+
+		convey.Convey("An invalid payload should list the failing fields", func() {
+			threshold := -1.0
+			evt, _ := NewTypedEvent(er, testSensorPayload{Readings: []int{1, 2, 3}, Threshold: &threshold, Location: &testSensorPlace{}})
+			err := et.Validate(evt)
+			assert.ErrorIs(t, err, ErrInvalidPayload)
+			verr, ok := err.(*ValidationError)
+			assert.True(t, ok, "Expected a *ValidationError, but got %T", err)
+			assert.Equal(t, "sensor-read", verr.EventType)
+			assert.Equal(t, evt.Id, verr.EventId)
+			fields := map[string]bool{}
+			for _, f := range verr.Fields {
+				fields[f.Field] = true
+			}
+			assert.Equal(t, map[string]bool{"/serial": true, "/readings": true, "/threshold": true, "/location/room": true}, fields)
+		})
+	})
+
+	convey.Convey("Given an event type with a recursive payload struct", t, func() {
+		er := NewEventRegistry()
+		et, _ := RegisterTyped[testTreeNode](er, "node-added", NewJsonCodec(nil))
+
+		convey.Convey("Its schema should be generated", func() {
+			err := et.GenerateSchema()
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			convey.Convey("And check the nested values", func() {
+				evt, _ := NewTypedEvent(er, testTreeNode{Name: "leaf", Parent: &testTreeNode{Name: "root"}})
+				assert.NoError(t, et.Validate(evt))
+
+				evt, _ = NewTypedEvent(er, testTreeNode{Name: "leaf", Children: []*testTreeNode{{}}})
+				err := et.Validate(evt)
+				verr, ok := err.(*ValidationError)
+				assert.True(t, ok, "Expected a *ValidationError, but got %T", err)
+				assert.Equal(t, []FieldError{{Field: "/children/0/name", Message: verr.Fields[0].Message}}, verr.Fields)
+			})
+		})
+	})
+
+	convey.Convey("Given an event type without payload prototype", t, func() {
+		et := NewEventType("untyped", "JSON Codec", func() *Event { return &Event{} })
+
+		convey.Convey("Generating the schema should fail", func() {
+			assert.Error(t, et.GenerateSchema(), "Expected an error")
+		})
+	})
+}
+
+func TestEventType_SetSchema(t *testing.T) {
+	convey.Convey("Given an event type with a hand written schema", t, func() {
+		et := NewEventType("device-created", "JSON Codec", nil)
+		err := et.SetSchema([]byte(`{
+			"type": "object",
+			"properties": {"serial": {"type": "string", "pattern": "^[0-9]+$"}},
+			"required": ["serial", "owner"]
+		}`))
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+
+		convey.Convey("Missing and malformed fields should be reported one by one", func() {
+			err := et.Validate(&Event{Id: "event-1", Payload: map[string]interface{}{"serial": "abc"}})
+			verr, ok := err.(*ValidationError)
+			assert.True(t, ok, "Expected a *ValidationError, but got %T", err)
+			assert.ElementsMatch(t, []string{"/serial", "/owner"}, []string{verr.Fields[0].Field, verr.Fields[1].Field})
+		})
+
+		convey.Convey("Encrypted payloads should not be checked", func() {
+			err := et.Validate(&Event{Id: "event-1", Payload: []byte{1, 2}, Encrypted: true})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+		})
+	})
+
+	convey.Convey("Given an invalid schema", t, func() {
+		et := NewEventType("device-created", "JSON Codec", nil)
+
+		convey.Convey("Setting it should fail", func() {
+			assert.Error(t, et.SetSchema([]byte(`{"type": 12}`)), "Expected an error")
+			assert.Nil(t, et.Schema())
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	// ErrPayloadTypeRegistered is returned by RegisterTyped when the payload type
+	// is already bound to another event type
+	ErrPayloadTypeRegistered = errors.New("payload type already registered")
+	// ErrUnknownPayloadType is returned by NewTypedEvent for payload types never registered
+	ErrUnknownPayloadType = errors.New("unknown payload type")
+	// ErrPayloadType is returned by PayloadAs when the payload cannot be converted
+	ErrPayloadType = errors.New("unexpected payload type")
+)
+
+// RegisterTyped registers an event type whose payload is T, deriving the
+// init function from it. The codec is registered too, if not already.
+// Each payload type can be bound to a single event type
+func RegisterTyped[T any](er *EventRegistry, name string, codec Codec) (*EventType, error) {
+	t := typeOf[T]()
+	if registered, ok := er.payloadTypes[t]; ok && registered != name {
+		return nil, fmt.Errorf("%w: %s is bound to %q", ErrPayloadTypeRegistered, t, registered)
+	}
+	if er.GetCodec(codec.Name()) == nil {
+		er.RegisterCodec(codec)
+	}
+
+	et := NewEventType(name, codec.Name(), func() *Event {
+		var payload T
+		return &Event{
+			Type:      name,
+			Timestamp: time.Now(),
+			Meta:      map[string]string{},
+			Payload:   payload,
+		}
+	})
+	er.Register(et)
+	er.payloadTypes[t] = name
+	return et, nil
+}
+
+// NewTypedEvent creates a new event of the type registered for T with the given payload
+func NewTypedEvent[T any](er *EventRegistry, payload T) (*Event, error) {
+	name, ok := er.payloadTypes[typeOf[T]()]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPayloadType, typeOf[T]())
+	}
+	evt := er.NewEvent(name)
+	evt.Payload = payload
+	return evt, nil
+}
+
+// PayloadAs returns the event payload as a T. Pointers to T are dereferenced
+// and generic JSON values are converted
+func PayloadAs[T any](e *Event) (T, error) {
+	var zero T
+	switch payload := e.Payload.(type) {
+	case T:
+		return payload, nil
+	case *T:
+		if payload != nil {
+			return *payload, nil
+		}
+	case map[string]interface{}:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return zero, err
+		}
+		var converted T
+		err = json.Unmarshal(data, &converted)
+		if err != nil {
+			return zero, fmt.Errorf("%w: %v", ErrPayloadType, err)
+		}
+		return converted, nil
+	}
+	return zero, fmt.Errorf("%w: %T is not %s", ErrPayloadType, e.Payload, typeOf[T]())
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
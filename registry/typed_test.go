@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+type deviceCreated struct {
+	Serial string `json:"serial"`
+}
+
+type deviceRemoved struct {
+	Reason string `json:"reason"`
+}
+
+func TestRegisterTyped(t *testing.T) {
+	convey.Convey("Given an event registry and a codec", t, func() {
+		er := NewEventRegistry()
+		codec := NewJsonCodec(nil)
+
+		convey.Convey("When registering a typed event", func() {
+			et, err := RegisterTyped[deviceCreated](er, "device-created", codec)
+
+			convey.Convey("The event type and the codec should be registered", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, et, er.GetType("device-created"))
+				assert.Equal(t, codec, er.GetCodec(codec.Name()))
+			})
+
+			convey.Convey("New events should have the registered name and payload type", func() {
+				evt := er.NewEvent("device-created")
+				assert.Equal(t, "device-created", evt.Type)
+				assert.Equal(t, deviceCreated{}, evt.Payload)
+			})
+
+			convey.Convey("Binding the payload type to another event type should fail", func() {
+				_, err = RegisterTyped[deviceCreated](er, "device-added", codec)
+				assert.ErrorIs(t, err, ErrPayloadTypeRegistered)
+				assert.Nil(t, er.GetType("device-added"))
+			})
+		})
+	})
+}
+
+func TestNewTypedEvent(t *testing.T) {
+	convey.Convey("Given an event registry with a typed event", t, func() {
+		er := NewEventRegistry()
+		RegisterTyped[deviceCreated](er, "device-created", NewJsonCodec(nil))
+
+		convey.Convey("Creating an event from a registered payload should set type and payload", func() {
+			evt, err := NewTypedEvent(er, deviceCreated{Serial: "123"})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, "device-created", evt.Type)
+			assert.Equal(t, deviceCreated{Serial: "123"}, evt.Payload)
+			assert.NotEmpty(t, evt.Id)
+			assert.Equal(t, er, evt.Registry)
+		})
+
+		convey.Convey("Creating an event from an unknown payload should fail", func() {
+			_, err := NewTypedEvent(er, deviceRemoved{})
+			assert.ErrorIs(t, err, ErrUnknownPayloadType)
+		})
+	})
+}
+
+func TestPayloadAs(t *testing.T) {
+	convey.Convey("Given events with different payload representations", t, func() {
+		convey.Convey("A payload of the requested type should be returned as is", func() {
+			payload, err := PayloadAs[deviceCreated](&Event{Payload: deviceCreated{Serial: "123"}})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, deviceCreated{Serial: "123"}, payload)
+		})
+
+		convey.Convey("A pointer payload should be dereferenced", func() {
+			payload, err := PayloadAs[deviceCreated](&Event{Payload: &deviceCreated{Serial: "123"}})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, deviceCreated{Serial: "123"}, payload)
+		})
+
+		convey.Convey("A generic JSON payload should be converted", func() {
+			payload, err := PayloadAs[deviceCreated](&Event{Payload: map[string]interface{}{"serial": "123"}})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, deviceCreated{Serial: "123"}, payload)
+		})
+
+		convey.Convey("A payload of another type should fail", func() {
+			_, err := PayloadAs[deviceCreated](&Event{Payload: deviceRemoved{}})
+			assert.ErrorIs(t, err, ErrPayloadType)
+		})
+
+		convey.Convey("A redacted payload should fail", func() {
+			_, err := PayloadAs[deviceCreated](&Event{Redacted: true})
+			assert.ErrorIs(t, err, ErrPayloadType)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package snapshot
+
+import (
+	"context"
+	"sync"
+)
+
+// MemorySnapshotStore is a SnapshotStore keeping the snapshots in process memory,
+// it is safe for concurrent use
+type MemorySnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[string]Snapshot
+}
+
+func NewMemorySnapshotStore() *MemorySnapshotStore {
+	return &MemorySnapshotStore{snapshots: make(map[string]Snapshot)}
+}
+
+func (m *MemorySnapshotStore) Get(id string) (*Snapshot, error) {
+	return m.GetCtx(context.Background(), id)
+}
+
+func (m *MemorySnapshotStore) GetCtx(ctx context.Context, id string) (*Snapshot, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.snapshots[id]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	s.Data = append([]byte(nil), s.Data...)
+	return &s, nil
+}
+
+func (m *MemorySnapshotStore) Save(s *Snapshot) error {
+	return m.SaveCtx(context.Background(), s)
+}
+
+func (m *MemorySnapshotStore) SaveCtx(ctx context.Context, s *Snapshot) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *s
+	stored.Data = append([]byte(nil), s.Data...)
+	m.snapshots[s.EntityId] = stored
+	return nil
+}
+
+func (m *MemorySnapshotStore) Delete(id string) error {
+	return m.DeleteCtx(context.Background(), id)
+}
+
+func (m *MemorySnapshotStore) DeleteCtx(ctx context.Context, id string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.snapshots, id)
+	return nil
+}
@@ -0,0 +1,41 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySnapshotStore(t *testing.T) {
+	convey.Convey("Given an in-memory snapshot store", t, func() {
+		ss := NewMemorySnapshotStore()
+
+		convey.Convey("Get should fail for an unknown entity", func() {
+			_, err := ss.Get("e1")
+			assert.ErrorIs(t, err, ErrSnapshotNotFound)
+		})
+
+		convey.Convey("When saving a snapshot", func() {
+			data := []byte(`{"name":"a"}`)
+			err := ss.Save(&Snapshot{EntityId: "e1", Sequence: 3, Timestamp: time.Now(), Data: data})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			data[2] = 'X'
+
+			convey.Convey("Get should return a copy of it", func() {
+				s, err := ss.Get("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(3), s.Sequence)
+				assert.Equal(t, []byte(`{"name":"a"}`), s.Data)
+			})
+
+			convey.Convey("Delete should remove it", func() {
+				err := ss.Delete("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				_, err = ss.Get("e1")
+				assert.ErrorIs(t, err, ErrSnapshotNotFound)
+			})
+		})
+	})
+}
@@ -0,0 +1,107 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lucacox/event-sourcing/internal/kvbucket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// defaultTimeout bounds the methods that do not take a context
+const defaultTimeout = 20 * time.Second
+
+type NATSSnapshotStoreConfig struct {
+	// Bucket is the name of the Key-Value bucket, "snapshots" if empty
+	Bucket string
+	// Replicas of the bucket, 1 if zero
+	Replicas int
+}
+
+// NATSSnapshotStore keeps the snapshots in a JetStream Key-Value bucket, created on
+// first use. Snapshots are stored by entity id, so entity ids must be valid NATS KV keys
+type NATSSnapshotStore struct {
+	opts   NATSSnapshotStoreConfig
+	bucket *kvbucket.Bucket
+}
+
+func NewNATSSnapshotStore(nc *nats.Conn, opt NATSSnapshotStoreConfig) (*NATSSnapshotStore, error) {
+	if opt.Bucket == "" {
+		opt.Bucket = "snapshots"
+	}
+	if opt.Replicas == 0 {
+		opt.Replicas = 1
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	bucket := kvbucket.New(js, jetstream.KeyValueConfig{
+		Bucket:   opt.Bucket,
+		Replicas: opt.Replicas,
+	})
+	return &NATSSnapshotStore{opts: opt, bucket: bucket}, nil
+}
+
+func (nss *NATSSnapshotStore) Get(id string) (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nss.GetCtx(ctx, id)
+}
+
+func (nss *NATSSnapshotStore) GetCtx(ctx context.Context, id string) (*Snapshot, error) {
+	kv, err := nss.bucket.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	err = json.Unmarshal(entry.Value(), s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (nss *NATSSnapshotStore) Save(s *Snapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nss.SaveCtx(ctx, s)
+}
+
+func (nss *NATSSnapshotStore) SaveCtx(ctx context.Context, s *Snapshot) error {
+	kv, err := nss.bucket.Get(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, s.EntityId, data)
+	return err
+}
+
+func (nss *NATSSnapshotStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return nss.DeleteCtx(ctx, id)
+}
+
+// DeleteCtx purges the snapshot, removing its past values from the bucket history too
+func (nss *NATSSnapshotStore) DeleteCtx(ctx context.Context, id string) error {
+	kv, err := nss.bucket.Get(ctx)
+	if err != nil {
+		return err
+	}
+	return kv.Purge(ctx, id)
+}
@@ -0,0 +1,65 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/internal/natstest"
+)
+
+func TestNATSSnapshotStore(t *testing.T) {
+	convey.Convey("Given a NATS snapshot store on an embedded server", t, func() {
+		nc, err := nats.Connect(natstest.RunServer(t))
+		if err != nil {
+			t.Fatalf("cannot connect to the NATS server: %v", err)
+		}
+		t.Cleanup(nc.Close)
+		ss, err := NewNATSSnapshotStore(nc, NATSSnapshotStoreConfig{})
+		assert.NoError(t, err, "Expected no error, but got %v", err)
+
+		convey.Convey("Get should fail for an unknown entity", func() {
+			_, err := ss.Get("e1")
+			assert.ErrorIs(t, err, ErrSnapshotNotFound)
+		})
+
+		convey.Convey("When saving a snapshot", func() {
+			timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			err := ss.Save(&Snapshot{EntityId: "e1", Sequence: 3, Timestamp: timestamp, Data: []byte(`{"name":"a"}`), Encrypted: true})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			convey.Convey("Get should return it", func() {
+				s, err := ss.Get("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, &Snapshot{EntityId: "e1", Sequence: 3, Timestamp: timestamp, Data: []byte(`{"name":"a"}`), Encrypted: true}, s)
+			})
+
+			convey.Convey("A later snapshot should replace it", func() {
+				err := ss.Save(&Snapshot{EntityId: "e1", Sequence: 5, Timestamp: timestamp, Data: []byte(`{"name":"b"}`)})
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				s, err := ss.Get("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(5), s.Sequence)
+				assert.Equal(t, []byte(`{"name":"b"}`), s.Data)
+				assert.False(t, s.Encrypted, "Expected snapshot not to be encrypted")
+			})
+
+			convey.Convey("Delete should remove it along with its past values", func() {
+				err := ss.Delete("e1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				_, err = ss.Get("e1")
+				assert.ErrorIs(t, err, ErrSnapshotNotFound)
+
+				kv, _ := ss.bucket.Get(context.Background())
+				history, _ := kv.History(context.Background(), "e1")
+				for _, entry := range history {
+					assert.Empty(t, entry.Value(), "Expected no past value of the snapshot")
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,38 @@
+package snapshot
+
+import "time"
+
+// Policy decides when a new snapshot of an entity is taken. A snapshot is due
+// when either limit is reached, a zero limit is disabled
+type Policy struct {
+	// Events is the number of events applied on top of the last snapshot
+	Events int
+	// Interval is the time elapsed since the last snapshot
+	Interval time.Duration
+}
+
+// EveryEvents returns a Policy taking a snapshot every n events
+func EveryEvents(n int) Policy {
+	return Policy{Events: n}
+}
+
+// EveryInterval returns a Policy taking a snapshot at most once every d, as long
+// as new events were applied
+func EveryInterval(d time.Duration) Policy {
+	return Policy{Interval: d}
+}
+
+// Due reports whether a new snapshot should be taken after applying the given
+// number of events on top of last, which is nil if the entity has no snapshot yet
+func (p Policy) Due(last *Snapshot, applied int, now time.Time) bool {
+	if applied == 0 {
+		return false
+	}
+	if p.Events > 0 && applied >= p.Events {
+		return true
+	}
+	if p.Interval > 0 {
+		return last == nil || now.Sub(last.Timestamp) >= p.Interval
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Due(t *testing.T) {
+	now := time.Now()
+	last := &Snapshot{EntityId: "e1", Sequence: 10, Timestamp: now.Add(-time.Minute)}
+
+	convey.Convey("Given a policy every 100 events", t, func() {
+		p := EveryEvents(100)
+
+		convey.Convey("A snapshot should be due only after 100 events", func() {
+			assert.False(t, p.Due(nil, 99, now))
+			assert.True(t, p.Due(nil, 100, now))
+			assert.True(t, p.Due(last, 150, now))
+		})
+	})
+
+	convey.Convey("Given a policy every 30 seconds", t, func() {
+		p := EveryInterval(30 * time.Second)
+
+		convey.Convey("A snapshot should be due when the last one is older", func() {
+			assert.True(t, p.Due(last, 1, now))
+			assert.False(t, p.Due(&Snapshot{Timestamp: now.Add(-time.Second)}, 1, now))
+			assert.True(t, p.Due(nil, 1, now))
+		})
+
+		convey.Convey("A snapshot should not be due without new events", func() {
+			assert.False(t, p.Due(last, 0, now))
+		})
+	})
+
+	convey.Convey("Given the zero policy", t, func() {
+		convey.Convey("A snapshot should never be due", func() {
+			assert.False(t, Policy{}.Due(nil, 1000, now))
+		})
+	})
+}
@@ -0,0 +1,32 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned when an entity has no snapshot in the store
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is the serialized state of an entity after applying all its events
+// up to Sequence
+type Snapshot struct {
+	EntityId  string    `json:"entity_id"`
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      []byte    `json:"data"`
+	// Encrypted is set when Data is encrypted with the entity key
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// SnapshotStore keeps the latest snapshot of each entity. The Ctx variants honor
+// the given context cancellation and deadline
+type SnapshotStore interface {
+	Get(string) (*Snapshot, error)
+	GetCtx(context.Context, string) (*Snapshot, error)
+	Save(*Snapshot) error
+	SaveCtx(context.Context, *Snapshot) error
+	Delete(string) error
+	DeleteCtx(context.Context, string) error
+}
@@ -0,0 +1,44 @@
+package store
+
+import "github.com/lucacox/event-sourcing/registry"
+
+// Aggregate is an Entity whose commands record new events instead of storing
+// them, a Repository saves them all at once checking the entity version
+type Aggregate interface {
+	Entity
+	// Version is the sequence of the last stored event of the entity, 0 for a new one
+	Version() uint64
+	SetVersion(uint64)
+	// Uncommitted returns the events recorded since the last save
+	Uncommitted() []*registry.Event
+	ClearUncommitted()
+}
+
+// AggregateBase implements the Aggregate bookkeeping, it's meant to be embedded
+// in entities that only have to implement Id and Project
+type AggregateBase struct {
+	version     uint64
+	uncommitted []*registry.Event
+}
+
+func (a *AggregateBase) Version() uint64 {
+	return a.version
+}
+
+func (a *AggregateBase) SetVersion(version uint64) {
+	a.version = version
+}
+
+// Record adds events to be saved with the entity. They are projected on the
+// entity only once saved, so commands check their rules on the stored state
+func (a *AggregateBase) Record(events ...*registry.Event) {
+	a.uncommitted = append(a.uncommitted, events...)
+}
+
+func (a *AggregateBase) Uncommitted() []*registry.Event {
+	return a.uncommitted
+}
+
+func (a *AggregateBase) ClearUncommitted() {
+	a.uncommitted = nil
+}
@@ -1,14 +1,27 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/keystore"
 	"github.com/lucacox/event-sourcing/registry"
+	"github.com/lucacox/event-sourcing/snapshot"
 )
 
+// ErrNoKeyStore is returned by Forget when no codec encrypts payloads
+var ErrNoKeyStore = errors.New("no key store set")
+
 type EventStore struct {
 	name string
 	be   backend.Backend
 	er   *registry.EventRegistry
+	ss   snapshot.SnapshotStore
+	sp   snapshot.Policy
 	rf   int
 }
 
@@ -20,6 +33,14 @@ func NewEventStore(name string, be backend.Backend, er *registry.EventRegistry,
 	return &EventStore{name: name, be: be, er: er, rf: replicationFactor}
 }
 
+// SetSnapshotStore enables entity snapshots: Project restores the entity from its
+// latest snapshot, replays only the events after it and takes a new snapshot
+// when the policy says so. Entities are snapshotted as JSON
+func (es *EventStore) SetSnapshotStore(ss snapshot.SnapshotStore, policy snapshot.Policy) {
+	es.ss = ss
+	es.sp = policy
+}
+
 // Start connects to the backend and sets up the store
 func (es *EventStore) Start() error {
 	err := es.be.Connect()
@@ -29,6 +50,15 @@ func (es *EventStore) Start() error {
 	return es.be.Setup(es.name, es.rf)
 }
 
+// StartCtx is like Start but the store setup is bound to ctx
+func (es *EventStore) StartCtx(ctx context.Context) error {
+	err := es.be.Connect()
+	if err != nil {
+		return err
+	}
+	return es.be.SetupCtx(ctx, es.name, es.rf)
+}
+
 // Stop closes the connection to the backend
 func (es *EventStore) Stop() error {
 	if es != nil && es.be != nil {
@@ -44,22 +74,263 @@ func (es *EventStore) NewEvent(name string) *registry.Event {
 	return e
 }
 
-// AddEvent synchronously adds a new event to the store and returns the sequence number
-func (es *EventStore) AddEvent(e *registry.Event, expectedSeq uint64) (uint64, error) {
-	return es.be.Save([]*registry.Event{e}, expectedSeq)
+// AddEvent synchronously adds a new event to the store and returns the new entity version.
+// expectedVersion is the version of the event entity the caller based its decision on,
+// use backend.AnyVersion to skip the check or backend.NoVersion for a new entity.
+// Payloads not matching the JSON Schema of their type are rejected with a
+// *registry.ValidationError before reaching the backend
+func (es *EventStore) AddEvent(e *registry.Event, expectedVersion uint64) (uint64, error) {
+	events := []*registry.Event{e}
+	err := es.validate(events)
+	if err != nil {
+		return 0, err
+	}
+	stamp(context.Background(), events)
+	return es.be.Save(events, expectedVersion)
+}
+
+// AddEventCtx is like AddEvent but the write is bound to ctx, and the event
+// gets the metadata carried by ctx (see registry.WithMetadata)
+func (es *EventStore) AddEventCtx(ctx context.Context, e *registry.Event, expectedVersion uint64) (uint64, error) {
+	events := []*registry.Event{e}
+	err := es.validate(events)
+	if err != nil {
+		return 0, err
+	}
+	stamp(ctx, events)
+	return es.be.SaveCtx(ctx, events, expectedVersion)
+}
+
+// AddEvents synchronously adds a batch of events of the same entity to the store and
+// returns the new entity version. Either all the events are stored or none of them
+func (es *EventStore) AddEvents(events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	err := es.validate(events)
+	if err != nil {
+		return 0, err
+	}
+	stamp(context.Background(), events)
+	return es.be.Save(events, expectedVersion)
+}
+
+// AddEventsCtx is like AddEvents but the write is bound to ctx, and the events
+// get the metadata carried by ctx (see registry.WithMetadata)
+func (es *EventStore) AddEventsCtx(ctx context.Context, events []*registry.Event, expectedVersion uint64) (uint64, error) {
+	err := es.validate(events)
+	if err != nil {
+		return 0, err
+	}
+	stamp(ctx, events)
+	return es.be.SaveCtx(ctx, events, expectedVersion)
+}
+
+// validate checks the events payloads against the JSON Schema of their type,
+// failing on the first invalid event
+func (es *EventStore) validate(events []*registry.Event) error {
+	for _, e := range events {
+		et := es.er.GetType(e.Type)
+		if et == nil {
+			continue
+		}
+		err := et.Validate(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version returns the current version of an entity, that is the sequence number of its last event
+func (es *EventStore) Version(id string) (uint64, error) {
+	return es.be.Version(id)
+}
+
+// VersionCtx is like Version but the lookup is bound to ctx
+func (es *EventStore) VersionCtx(ctx context.Context, id string) (uint64, error) {
+	return es.be.VersionCtx(ctx, id)
+}
+
+// Subscribe delivers to handler, in order, the stored events matching filter starting
+// from the fromSeq stream sequence (0 for the whole history), then keeps delivering
+// new events as they are added. It blocks until ctx is done, returning its error, or
+// until handler returns an error
+func (es *EventStore) Subscribe(ctx context.Context, filter backend.Filter, fromSeq uint64, handler backend.EventHandler) error {
+	return es.be.Subscribe(ctx, filter, fromSeq, handler)
+}
+
+// LoadByCorrelationId returns, in stream order, all the events of a causal chain
+func (es *EventStore) LoadByCorrelationId(id string) ([]*registry.Event, error) {
+	return es.be.LoadByCorrelationId(id)
+}
+
+// LoadByCorrelationIdCtx is like LoadByCorrelationId but loading the events is bound to ctx
+func (es *EventStore) LoadByCorrelationIdCtx(ctx context.Context, id string) ([]*registry.Event, error) {
+	return es.be.LoadByCorrelationIdCtx(ctx, id)
+}
+
+// CausalChain returns the events that led to evt, following their causation ids
+// from the root of the chain down to evt itself. An event without correlation id
+// is a chain of its own
+func (es *EventStore) CausalChain(evt *registry.Event) ([]*registry.Event, error) {
+	if evt.Metadata().CorrelationId == "" {
+		return []*registry.Event{evt}, nil
+	}
+	events, err := es.LoadByCorrelationId(evt.Metadata().CorrelationId)
+	if err != nil {
+		return nil, err
+	}
+	return causalChain(events, evt), nil
+}
+
+// CausalChainCtx is like CausalChain but loading the events is bound to ctx
+func (es *EventStore) CausalChainCtx(ctx context.Context, evt *registry.Event) ([]*registry.Event, error) {
+	if evt.Metadata().CorrelationId == "" {
+		return []*registry.Event{evt}, nil
+	}
+	events, err := es.LoadByCorrelationIdCtx(ctx, evt.Metadata().CorrelationId)
+	if err != nil {
+		return nil, err
+	}
+	return causalChain(events, evt), nil
+}
+
+// Forget makes the payloads of an entity events unreadable deleting its key
+// (crypto-shredding). Events are immutable and stay in the store, once
+// loaded again they are marked as Redacted and have no payload. The entity
+// snapshot, holding the decrypted state, is deleted too. The key is deleted from
+// the KeyStore of the registry codecs, new events of the entity are rejected
+func (es *EventStore) Forget(id string) error {
+	ks, err := es.keyStore()
+	if err != nil {
+		return err
+	}
+	err = ks.DeleteKey(id)
+	if err != nil || es.ss == nil {
+		return err
+	}
+	return es.ss.Delete(id)
+}
+
+// ForgetCtx is like Forget but the key and snapshot deletion is bound to ctx
+func (es *EventStore) ForgetCtx(ctx context.Context, id string) error {
+	ks, err := es.keyStore()
+	if err != nil {
+		return err
+	}
+	err = ks.DeleteKeyCtx(ctx, id)
+	if err != nil || es.ss == nil {
+		return err
+	}
+	return es.ss.DeleteCtx(ctx, id)
+}
+
+// keyStore returns the KeyStore shared by the codecs encrypting payloads
+func (es *EventStore) keyStore() (keystore.KeyStore, error) {
+	ks, err := es.er.KeyStore()
+	if err != nil {
+		return nil, err
+	}
+	if ks == nil {
+		return nil, ErrNoKeyStore
+	}
+	return ks, nil
 }
 
 // Project applies all events for a given entity to the model
 // and returns the last sequence number applied and the error if any
 func (es *EventStore) Project(model Entity) (uint64, error) {
+	if es.ss == nil {
+		events, err := es.be.LoadByEntityId(model.Id())
+		if err != nil {
+			return 0, err
+		}
+		return es.apply(model, events)
+	}
+	return es.projectSnapshot(context.Background(), model, es.ss.Get, es.ss.Save, es.be.LoadByEntityIdFrom)
+}
+
+// ProjectCtx is like Project but loading the events and the snapshots is bound to ctx
+func (es *EventStore) ProjectCtx(ctx context.Context, model Entity) (uint64, error) {
+	if es.ss == nil {
+		events, err := es.be.LoadByEntityIdCtx(ctx, model.Id())
+		if err != nil {
+			return 0, err
+		}
+		return es.apply(model, events)
+	}
+	return es.projectSnapshot(ctx, model,
+		func(id string) (*snapshot.Snapshot, error) { return es.ss.GetCtx(ctx, id) },
+		func(s *snapshot.Snapshot) error { return es.ss.SaveCtx(ctx, s) },
+		func(id string, startSeq uint64) ([]*registry.Event, error) {
+			return es.be.LoadByEntityIdFromCtx(ctx, id, startSeq)
+		})
+}
+
+// ProjectAsOf applies the events of an entity up to the seq stream sequence, rebuilding
+// the model as it was at that point in history. Snapshots are not used. Returns the
+// last sequence number applied and the error if any
+func (es *EventStore) ProjectAsOf(model Entity, seq uint64) (uint64, error) {
 	events, err := es.be.LoadByEntityId(model.Id())
 	if err != nil {
 		return 0, err
 	}
+	return es.applyUntil(model, events, func(e *registry.Event) bool { return e.Sequence > seq })
+}
+
+// ProjectAsOfCtx is like ProjectAsOf but loading the events is bound to ctx
+func (es *EventStore) ProjectAsOfCtx(ctx context.Context, model Entity, seq uint64) (uint64, error) {
+	events, err := es.be.LoadByEntityIdCtx(ctx, model.Id())
+	if err != nil {
+		return 0, err
+	}
+	return es.applyUntil(model, events, func(e *registry.Event) bool { return e.Sequence > seq })
+}
+
+// ProjectAt applies the events of an entity up to the first one whose Timestamp is
+// after t, rebuilding the model as it was at that time. Snapshots are not used.
+// Returns the last sequence number applied and the error if any
+func (es *EventStore) ProjectAt(model Entity, t time.Time) (uint64, error) {
+	events, err := es.be.LoadByEntityId(model.Id())
+	if err != nil {
+		return 0, err
+	}
+	return es.applyUntil(model, events, func(e *registry.Event) bool { return e.Timestamp.After(t) })
+}
+
+// ProjectAtCtx is like ProjectAt but loading the events is bound to ctx
+func (es *EventStore) ProjectAtCtx(ctx context.Context, model Entity, t time.Time) (uint64, error) {
+	events, err := es.be.LoadByEntityIdCtx(ctx, model.Id())
+	if err != nil {
+		return 0, err
+	}
+	return es.applyUntil(model, events, func(e *registry.Event) bool { return e.Timestamp.After(t) })
+}
+
+// ProjectAll applies all events for a given list of entities to the models
+// and returns a map of the last sequence number applied and a map of errors if any
+func (es *EventStore) ProjectAll(models []Entity) (map[string]uint64, map[string]error) {
+	return es.projectAll(models, es.Project)
+}
+
+// ProjectAllCtx is like ProjectAll but loading the events is bound to ctx
+func (es *EventStore) ProjectAllCtx(ctx context.Context, models []Entity) (map[string]uint64, map[string]error) {
+	return es.projectAll(models, func(m Entity) (uint64, error) {
+		return es.ProjectCtx(ctx, m)
+	})
+}
+
+// apply projects events on the model in order, stopping at the first error
+func (es *EventStore) apply(model Entity, events []*registry.Event) (uint64, error) {
+	return es.applyUntil(model, events, func(*registry.Event) bool { return false })
+}
 
+// applyUntil is like apply but stops before the first event matching stop
+func (es *EventStore) applyUntil(model Entity, events []*registry.Event, stop func(*registry.Event) bool) (uint64, error) {
 	var lastSeq uint64
 	for _, e := range events {
-		err = model.Project(e)
+		if stop(e) {
+			break
+		}
+		err := model.Project(e)
 		if err != nil {
 			return e.Sequence, err
 		}
@@ -69,13 +340,158 @@ func (es *EventStore) Project(model Entity) (uint64, error) {
 	return lastSeq, nil
 }
 
-// ProjectAll applies all events for a given list of entities to the models
-// and returns a map of the last sequence number applied and a map of errors if any
-func (es *EventStore) ProjectAll(models []Entity) (map[string]uint64, map[string]error) {
+// projectSnapshot restores the model from its latest snapshot, applies the events
+// after it and takes a new snapshot if due. Failing to save the snapshot does not
+// fail the projection, it will be taken again by a later Project
+func (es *EventStore) projectSnapshot(
+	ctx context.Context,
+	model Entity,
+	get func(string) (*snapshot.Snapshot, error),
+	save func(*snapshot.Snapshot) error,
+	load func(string, uint64) ([]*registry.Event, error),
+) (uint64, error) {
+	ks, err := es.er.KeyStore()
+	if err != nil {
+		return 0, err
+	}
+	// the key is read once to restore the snapshot and to take the new one
+	ctx = keystore.WithKeyCache(ctx)
+
+	var lastSeq uint64
+	last, err := get(model.Id())
+	if err == nil {
+		err = restore(ctx, ks, last, model)
+	}
+	switch {
+	case errors.Is(err, snapshot.ErrSnapshotNotFound):
+		last = nil
+	case err != nil:
+		return 0, err
+	default:
+		lastSeq = last.Sequence
+	}
+
+	events, err := load(model.Id(), lastSeq+1)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := es.apply(model, events)
+	if err != nil {
+		return seq, err
+	}
+	if len(events) == 0 {
+		return lastSeq, nil
+	}
+
+	now := time.Now()
+	if es.sp.Due(last, len(events), now) {
+		s, err := take(ctx, ks, model, seq, now)
+		if err == nil {
+			save(s)
+		}
+	}
+	return seq, nil
+}
+
+// take returns the snapshot of model, encrypted with the entity key if it has one
+// as it holds the decrypted state. Forgotten entities are not snapshotted
+func take(ctx context.Context, ks keystore.KeyStore, model Entity, seq uint64, now time.Time) (*snapshot.Snapshot, error) {
+	data, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot.Snapshot{EntityId: model.Id(), Sequence: seq, Timestamp: now, Data: data}
+	if ks == nil {
+		return s, nil
+	}
+	key, err := keystore.CachedKey(ctx, ks, s.EntityId)
+	if errors.Is(err, keystore.ErrKeyNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Data, err = keystore.Seal(key, data, authenticatedData(s))
+	if err != nil {
+		return nil, err
+	}
+	s.Encrypted = true
+	return s, nil
+}
+
+// restore applies the snapshot to model. Encrypted snapshots whose entity key is
+// missing or deleted cannot be read and are reported as ErrSnapshotNotFound, the
+// model is then rebuilt from its events
+func restore(ctx context.Context, ks keystore.KeyStore, s *snapshot.Snapshot, model Entity) error {
+	data := s.Data
+	if s.Encrypted {
+		if ks == nil {
+			return snapshot.ErrSnapshotNotFound
+		}
+		key, err := keystore.CachedKey(ctx, ks, s.EntityId)
+		if errors.Is(err, keystore.ErrKeyNotFound) || errors.Is(err, keystore.ErrKeyDeleted) {
+			return snapshot.ErrSnapshotNotFound
+		}
+		if err != nil {
+			return err
+		}
+		data, err = keystore.Open(key, s.Data, authenticatedData(s))
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, model)
+}
+
+// authenticatedData returns the snapshot fields authenticated along with its encrypted
+// data, so that it cannot be moved to another entity or sequence
+func authenticatedData(s *snapshot.Snapshot) []byte {
+	return []byte(fmt.Sprintf("%s.%d", s.EntityId, s.Sequence))
+}
+
+// stamp sets on the events the metadata carried by ctx, without overriding the
+// values already set. Events without correlation id start a new causal chain,
+// rooted at the first event of the batch
+func stamp(ctx context.Context, events []*registry.Event) {
+	if len(events) == 0 {
+		return
+	}
+	md := registry.MetadataFrom(ctx)
+	root := events[0].Metadata().Merge(md).CorrelationId
+	if root == "" {
+		root = events[0].Id
+	}
+	for _, e := range events {
+		e.SetMetadata(e.Metadata().Merge(md).Merge(registry.Metadata{CorrelationId: root}))
+	}
+}
+
+// causalChain walks up the causation ids of evt among events. The chain stops at
+// the first cause that is not an event of the store, like a command id
+func causalChain(events []*registry.Event, evt *registry.Event) []*registry.Event {
+	byId := make(map[string]*registry.Event, len(events))
+	for _, e := range events {
+		byId[e.Id] = e
+	}
+	chain := []*registry.Event{evt}
+	seen := map[string]bool{evt.Id: true}
+	for cause := evt.Metadata().CausationId; cause != "" && !seen[cause]; {
+		parent, ok := byId[cause]
+		if !ok {
+			break
+		}
+		seen[cause] = true
+		chain = append([]*registry.Event{parent}, chain...)
+		cause = parent.Metadata().CausationId
+	}
+	return chain
+}
+
+func (es *EventStore) projectAll(models []Entity, project func(Entity) (uint64, error)) (map[string]uint64, map[string]error) {
 	projections := make(map[string]uint64)
 	errors := make(map[string]error)
 	for _, m := range models {
-		seq, err := es.Project(m)
+		seq, err := project(m)
 		errors[m.Id()] = err
 		projections[m.Id()] = seq
 	}
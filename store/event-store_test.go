@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -8,7 +9,9 @@ import (
 	"github.com/smartystreets/goconvey/convey"
 
 	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/keystore"
 	"github.com/lucacox/event-sourcing/registry"
+	"github.com/lucacox/event-sourcing/snapshot"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -200,6 +203,75 @@ func TestEventStore_AddEvent(t *testing.T) {
 	})
 }
 
+func TestEventStore_AddEvents(t *testing.T) {
+	convey.Convey("Given an event store and a batch of events", t, func() {
+		name := "test-store"
+		be := new(backend.MockBackend)
+		er := registry.NewEventRegistry()
+		replicationFactor := 3
+		be.On("SetEventRegistry", er).Return()
+
+		eventTypeName := "test-event"
+		er.Register(registry.NewEventType(eventTypeName, "test-codec", func() *registry.Event {
+			return &registry.Event{
+				Type:      eventTypeName,
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+				Payload:   nil,
+			}
+		}))
+
+		store := NewEventStore(name, be, er, replicationFactor)
+
+		events := []*registry.Event{store.NewEvent(eventTypeName), store.NewEvent(eventTypeName)}
+
+		convey.Convey("When calling AddEvents and the backend stores the batch", func() {
+			be.On("Save", events, uint64(10)).Return(uint64(12), nil)
+			version, err := store.AddEvents(events, 10)
+
+			convey.Convey("The new entity version should be returned", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(12), version, "Expected version to be 12, but got %d", version)
+			})
+		})
+
+		convey.Convey("When calling AddEvents and the backend rejects the batch", func() {
+			expectedErr := &backend.ErrWrongSequence{EntityId: "test-entity", Expected: 10, Actual: 11}
+			be.On("Save", events, uint64(10)).Return(uint64(0), expectedErr)
+			version, err := store.AddEvents(events, 10)
+
+			convey.Convey("The backend error should be returned", func() {
+				assert.Equal(t, expectedErr, err, "Expected error %v, but got %v", expectedErr, err)
+				assert.Equal(t, uint64(0), version, "Expected version to be 0, but got %d", version)
+			})
+		})
+	})
+}
+
+func TestEventStore_Version(t *testing.T) {
+	convey.Convey("Given an event store", t, func() {
+		name := "test-store"
+		be := new(backend.MockBackend)
+		er := registry.NewEventRegistry()
+		replicationFactor := 3
+		be.On("SetEventRegistry", er).Return()
+
+		store := NewEventStore(name, be, er, replicationFactor)
+
+		convey.Convey("When calling Version", func() {
+			entityID := "test-entity"
+			be.On("Version", entityID).Return(uint64(7), nil)
+
+			version, err := store.Version(entityID)
+
+			convey.Convey("The backend entity version should be returned", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(7), version, "Expected version to be 7, but got %d", version)
+			})
+		})
+	})
+}
+
 func TestEventStore_Project(t *testing.T) {
 	convey.Convey("Given an event store and a model", t, func() {
 		name := "test-store"
@@ -319,6 +391,45 @@ func TestEventStore_Project(t *testing.T) {
 	})
 }
 
+func TestEventStore_ProjectCtx(t *testing.T) {
+	convey.Convey("Given an event store, a model and a context", t, func() {
+		name := "test-store"
+		be := new(backend.MockBackend)
+		er := registry.NewEventRegistry()
+		replicationFactor := 3
+		be.On("SetEventRegistry", er).Return()
+
+		store := NewEventStore(name, be, er, replicationFactor)
+
+		model := new(MockEntity)
+		entityID := "test-entity"
+		model.On("Id").Return(entityID)
+		model.On("Project", mock.Anything).Return(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		convey.Convey("When calling ProjectCtx", func() {
+			events := []*registry.Event{
+				{
+					Sequence: 4,
+					Payload:  []byte("event1"),
+				},
+			}
+			be.On("LoadByEntityIdCtx", ctx, entityID).Return(events, nil)
+
+			lastSeq, err := store.ProjectCtx(ctx, model)
+
+			convey.Convey("The context should reach the backend and the events be projected", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(4), lastSeq, "Expected last sequence number to be 4, but got %d", lastSeq)
+				be.AssertCalled(t, "LoadByEntityIdCtx", ctx, entityID)
+				model.AssertCalled(t, "Project", events[0])
+			})
+		})
+	})
+}
+
 func TestEventStore_ProjectAll(t *testing.T) {
 	convey.Convey("Given an event store and a list of models", t, func() {
 		name := "test-store"
@@ -397,3 +508,433 @@ func TestEventStore_ProjectAll(t *testing.T) {
 		})
 	})
 }
+
+func TestEventStore_Subscribe(t *testing.T) {
+	convey.Convey("Given an event store on an in-memory backend", t, func() {
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(nil)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      "test-event",
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+			}
+		}))
+		store := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+		store.Start()
+
+		evt := store.NewEvent("test-event")
+		evt.EntityId = "entity-1"
+		store.AddEvent(evt, backend.NoVersion)
+
+		convey.Convey("Subscribe should deliver the stored and the new events", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			received := []*registry.Event{}
+			err := store.Subscribe(ctx, backend.Filter{EntityId: "entity-1"}, 0, func(e *registry.Event) error {
+				received = append(received, e)
+				if len(received) == 1 {
+					evt := store.NewEvent("test-event")
+					evt.EntityId = "entity-1"
+					_, err := store.AddEvent(evt, e.Sequence)
+					return err
+				}
+				cancel()
+				return nil
+			})
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Len(t, received, 2, "Expected 2 events")
+		})
+	})
+}
+
+type recordingEntity struct {
+	id     string
+	events []*registry.Event
+}
+
+func (r *recordingEntity) Id() string {
+	return r.id
+}
+
+func (r *recordingEntity) Project(e *registry.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestEventStore_Forget(t *testing.T) {
+	convey.Convey("Given an event store with encrypted events for an entity", t, func() {
+		ks := keystore.NewMemoryKeyStore()
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(ks)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      "test-event",
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+			}
+		}))
+
+		store := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+		store.Start()
+
+		key, _ := keystore.GenerateKey()
+		ks.SetKey("entity-1", key)
+		for _, id := range []string{"entity-1", "entity-2"} {
+			evt := store.NewEvent("test-event")
+			evt.EntityId = id
+			evt.Payload = map[string]interface{}{"owner": "John Doe"}
+			store.AddEvent(evt, backend.AnyVersion)
+		}
+
+		convey.Convey("When forgetting the entity", func() {
+			err := store.Forget("entity-1")
+
+			convey.Convey("Its events should be projected with a redacted payload", func() {
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				model := &recordingEntity{id: "entity-1"}
+				_, err = store.Project(model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Len(t, model.events, 1, "Expected 1 event")
+				assert.True(t, model.events[0].Redacted, "Expected event to be redacted")
+				assert.Nil(t, model.events[0].Payload, "Expected no payload")
+			})
+
+			convey.Convey("New events of the entity should be rejected", func() {
+				evt := store.NewEvent("test-event")
+				evt.EntityId = "entity-1"
+				evt.Payload = map[string]interface{}{"owner": "Jane Doe"}
+				_, err := store.AddEvent(evt, backend.AnyVersion)
+				assert.ErrorIs(t, err, keystore.ErrKeyDeleted)
+			})
+
+			convey.Convey("Other entities should not be affected", func() {
+				model := &recordingEntity{id: "entity-2"}
+				_, err = store.Project(model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.False(t, model.events[0].Redacted, "Expected event not to be redacted")
+				assert.Equal(t, map[string]interface{}{"owner": "John Doe"}, model.events[0].Payload)
+			})
+		})
+
+		convey.Convey("Before forgetting the entity its payload should be readable", func() {
+			model := &recordingEntity{id: "entity-1"}
+			_, err := store.Project(model)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, map[string]interface{}{"owner": "John Doe"}, model.events[0].Payload)
+		})
+	})
+
+	convey.Convey("Given an event store without key store", t, func() {
+		be := new(backend.MockBackend)
+		er := registry.NewEventRegistry()
+		be.On("SetEventRegistry", er).Return()
+		store := NewEventStore("test-store", be, er, 1)
+
+		convey.Convey("Forget should fail", func() {
+			err := store.Forget("entity-1")
+			assert.ErrorIs(t, err, ErrNoKeyStore)
+		})
+	})
+}
+
+type counterEntity struct {
+	ID      string `json:"id"`
+	Count   int    `json:"count"`
+	applied int
+}
+
+func (c *counterEntity) Id() string {
+	return c.ID
+}
+
+func (c *counterEntity) Project(e *registry.Event) error {
+	c.Count++
+	c.applied++
+	return nil
+}
+
+func TestEventStore_Snapshots(t *testing.T) {
+	convey.Convey("Given an event store with snapshots every 3 events", t, func() {
+		er := registry.NewEventRegistry()
+		ks := keystore.NewMemoryKeyStore()
+		codec := registry.NewJsonCodec(ks)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      "test-event",
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+			}
+		}))
+		ss := snapshot.NewMemorySnapshotStore()
+		store := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+		store.SetSnapshotStore(ss, snapshot.EveryEvents(3))
+		store.Start()
+
+		addEvents := func(n int) {
+			for i := 0; i < n; i++ {
+				evt := store.NewEvent("test-event")
+				evt.EntityId = "entity-1"
+				store.AddEvent(evt, backend.AnyVersion)
+			}
+		}
+		addEvents(4)
+
+		convey.Convey("The first projection should replay every event and take a snapshot", func() {
+			model := &counterEntity{ID: "entity-1"}
+			seq, err := store.Project(model)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(4), seq)
+			assert.Equal(t, 4, model.applied)
+
+			s, err := ss.Get("entity-1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(4), s.Sequence)
+
+			convey.Convey("A later projection should replay only the new events", func() {
+				addEvents(2)
+				model := &counterEntity{ID: "entity-1"}
+				seq, err := store.ProjectCtx(context.Background(), model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(6), seq)
+				assert.Equal(t, 6, model.Count)
+				assert.Equal(t, 2, model.applied)
+
+				s, _ := ss.Get("entity-1")
+				assert.Equal(t, uint64(4), s.Sequence, "Expected the snapshot not to be due yet")
+			})
+
+			convey.Convey("A projection without new events should return the snapshot sequence", func() {
+				model := &counterEntity{ID: "entity-1"}
+				seq, err := store.Project(model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(4), seq)
+				assert.Equal(t, 4, model.Count)
+				assert.Equal(t, 0, model.applied)
+			})
+
+			convey.Convey("Forget should delete the snapshot", func() {
+				err := store.Forget("entity-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				_, err = ss.Get("entity-1")
+				assert.ErrorIs(t, err, snapshot.ErrSnapshotNotFound)
+			})
+		})
+
+		convey.Convey("The snapshot of an entity with a key should be encrypted", func() {
+			key, _ := keystore.GenerateKey()
+			ks.SetKey("entity-1", key)
+			_, err := store.Project(&counterEntity{ID: "entity-1"})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+
+			s, err := ss.Get("entity-1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.True(t, s.Encrypted, "Expected snapshot to be encrypted")
+			assert.NotContains(t, string(s.Data), `"count"`)
+
+			convey.Convey("And restored by a later projection", func() {
+				model := &counterEntity{ID: "entity-1"}
+				seq, err := store.Project(model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(4), seq)
+				assert.Equal(t, 4, model.Count)
+				assert.Equal(t, 0, model.applied)
+			})
+
+			convey.Convey("Once the key is deleted the entity should be rebuilt from its events", func() {
+				ks.DeleteKey("entity-1")
+				model := &counterEntity{ID: "entity-1"}
+				seq, err := store.Project(model)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				assert.Equal(t, uint64(4), seq)
+				assert.Equal(t, 4, model.applied)
+			})
+		})
+	})
+}
+
+func TestEventStore_ProjectAsOf(t *testing.T) {
+	convey.Convey("Given an entity with events a day apart", t, func() {
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(nil)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      "test-event",
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+			}
+		}))
+		store := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+		store.Start()
+
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 4; i++ {
+			evt := store.NewEvent("test-event")
+			evt.EntityId = "entity-1"
+			evt.Timestamp = start.Add(time.Duration(i) * 24 * time.Hour)
+			store.AddEvent(evt, backend.AnyVersion)
+			other := store.NewEvent("test-event")
+			other.EntityId = "entity-2"
+			store.AddEvent(other, backend.AnyVersion)
+		}
+
+		convey.Convey("ProjectAsOf should stop at the given sequence", func() {
+			model := &counterEntity{ID: "entity-1"}
+			seq, err := store.ProjectAsOf(model, 4)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(3), seq)
+			assert.Equal(t, 2, model.Count)
+		})
+
+		convey.Convey("ProjectAsOfCtx should include the event at the given sequence", func() {
+			model := &counterEntity{ID: "entity-1"}
+			seq, err := store.ProjectAsOfCtx(context.Background(), model, 5)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(5), seq)
+			assert.Equal(t, 3, model.Count)
+		})
+
+		convey.Convey("ProjectAt should stop at the given time", func() {
+			model := &counterEntity{ID: "entity-1"}
+			seq, err := store.ProjectAt(model, start.Add(36*time.Hour))
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(3), seq)
+			assert.Equal(t, 2, model.Count)
+		})
+
+		convey.Convey("ProjectAtCtx before the first event should apply nothing", func() {
+			model := &counterEntity{ID: "entity-1"}
+			seq, err := store.ProjectAtCtx(context.Background(), model, start.Add(-time.Hour))
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(0), seq)
+			assert.Equal(t, 0, model.Count)
+		})
+	})
+}
+
+func TestEventStore_Metadata(t *testing.T) {
+	convey.Convey("Given an event store on an in-memory backend", t, func() {
+		er := registry.NewEventRegistry()
+		codec := registry.NewJsonCodec(nil)
+		er.RegisterCodec(codec)
+		er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+			return &registry.Event{
+				Type:      "test-event",
+				Timestamp: time.Now(),
+				Meta:      map[string]string{},
+			}
+		}))
+		store := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+		store.Start()
+		newEvent := func(entityId string) *registry.Event {
+			evt := store.NewEvent("test-event")
+			evt.EntityId = entityId
+			return evt
+		}
+
+		convey.Convey("An event added without metadata should start a chain", func() {
+			evt := newEvent("e1")
+			store.AddEvent(evt, backend.AnyVersion)
+			assert.Equal(t, registry.Metadata{CorrelationId: evt.Id}, evt.Metadata())
+		})
+
+		convey.Convey("A batch added without metadata should share the first event chain", func() {
+			events := []*registry.Event{newEvent("e1"), newEvent("e1")}
+			store.AddEvents(events, backend.AnyVersion)
+			assert.Equal(t, events[0].Id, events[1].Metadata().CorrelationId)
+		})
+
+		convey.Convey("Events should get the metadata of the context", func() {
+			ctx := registry.WithMetadata(context.Background(), registry.Metadata{CorrelationId: "req-1", Actor: "john"})
+			evt := newEvent("e1")
+			evt.SetMetadata(registry.Metadata{Actor: "jane"})
+			store.AddEventCtx(ctx, evt, backend.AnyVersion)
+			assert.Equal(t, registry.Metadata{CorrelationId: "req-1", Actor: "jane"}, evt.Metadata())
+		})
+
+		convey.Convey("Given a chain of events across entities", func() {
+			ctx := registry.WithMetadata(context.Background(), registry.Metadata{CorrelationId: "req-1", CausationId: "cmd-1"})
+			root := newEvent("e1")
+			store.AddEventCtx(ctx, root, backend.AnyVersion)
+			store.AddEvent(newEvent("e3"), backend.AnyVersion)
+			child := newEvent("e2")
+			store.AddEventCtx(registry.WithCause(context.Background(), root), child, backend.AnyVersion)
+			sibling := newEvent("e3")
+			store.AddEventCtx(registry.WithCause(context.Background(), root), sibling, backend.AnyVersion)
+			grandchild := newEvent("e1")
+			store.AddEventCtx(registry.WithCause(context.Background(), child), grandchild, backend.AnyVersion)
+
+			convey.Convey("LoadByCorrelationId should return the whole chain in order", func() {
+				events, err := store.LoadByCorrelationId("req-1")
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				ids := []string{}
+				for _, e := range events {
+					ids = append(ids, e.Id)
+				}
+				assert.Equal(t, []string{root.Id, child.Id, sibling.Id, grandchild.Id}, ids)
+			})
+
+			convey.Convey("CausalChain should return the path from the root", func() {
+				events, err := store.CausalChainCtx(context.Background(), grandchild)
+				assert.NoError(t, err, "Expected no error, but got %v", err)
+				ids := []string{}
+				for _, e := range events {
+					ids = append(ids, e.Id)
+				}
+				assert.Equal(t, []string{root.Id, child.Id, grandchild.Id}, ids)
+			})
+		})
+
+		convey.Convey("The causal chain of an event without correlation id should be the event alone", func() {
+			evt := newEvent("e1")
+			events, err := store.CausalChain(evt)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, []*registry.Event{evt}, events)
+		})
+	})
+}
+
+type testSchemaPayload struct {
+	Serial string `json:"serial" jsonschema:"minLength=1"`
+}
+
+func TestEventStore_Validation(t *testing.T) {
+	convey.Convey("Given an event store with an event type having a schema", t, func() {
+		er := registry.NewEventRegistry()
+		et, _ := registry.RegisterTyped[testSchemaPayload](er, "device-created", registry.NewJsonCodec(nil))
+		et.GenerateSchema()
+		be := new(backend.MockBackend)
+		be.On("SetEventRegistry", er).Return()
+		store := NewEventStore("test-store", be, er, 1)
+
+		convey.Convey("AddEvent should reject an invalid payload before saving it", func() {
+			evt, _ := registry.NewTypedEvent(er, testSchemaPayload{})
+			evt.EntityId = "device-1"
+			_, err := store.AddEvent(evt, backend.NoVersion)
+			var verr *registry.ValidationError
+			assert.True(t, errors.As(err, &verr), "Expected a ValidationError, but got %v", err)
+			assert.Equal(t, []registry.FieldError{{Field: "/serial", Message: verr.Fields[0].Message}}, verr.Fields)
+			be.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+		})
+
+		convey.Convey("AddEvents should reject the whole batch", func() {
+			valid, _ := registry.NewTypedEvent(er, testSchemaPayload{Serial: "123"})
+			invalid, _ := registry.NewTypedEvent(er, testSchemaPayload{})
+			_, err := store.AddEventsCtx(context.Background(), []*registry.Event{valid, invalid}, backend.AnyVersion)
+			assert.ErrorIs(t, err, registry.ErrInvalidPayload)
+			be.AssertNotCalled(t, "SaveCtx", mock.Anything, mock.Anything, mock.Anything)
+		})
+
+		convey.Convey("AddEvent should save a valid payload", func() {
+			evt, _ := registry.NewTypedEvent(er, testSchemaPayload{Serial: "123"})
+			be.On("Save", []*registry.Event{evt}, backend.NoVersion).Return(uint64(1), nil)
+			version, err := store.AddEvent(evt, backend.NoVersion)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(1), version)
+		})
+	})
+}
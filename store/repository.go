@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+// RetryPolicy tells a Repository how many times a command is run again when the
+// entity changed between its load and its save
+type RetryPolicy struct {
+	// MaxRetries is the number of times a command is run again, zero disables retries
+	MaxRetries int
+	// RetryDelay is the wait before running the command again
+	RetryDelay time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of a new Repository
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3}
+
+// Repository loads and saves aggregates of type T, taking care of their version
+type Repository[T Aggregate] struct {
+	es        *EventStore
+	newEntity func(id string) T
+	policy    RetryPolicy
+}
+
+// NewRepository returns a Repository storing entities in es, newEntity returns
+// the empty entity with the given id that events are projected on
+func NewRepository[T Aggregate](es *EventStore, newEntity func(id string) T) *Repository[T] {
+	return &Repository[T]{es: es, newEntity: newEntity, policy: DefaultRetryPolicy}
+}
+
+// SetRetryPolicy sets the retry policy of Execute
+func (r *Repository[T]) SetRetryPolicy(policy RetryPolicy) {
+	r.policy = policy
+}
+
+// Load projects all the events of an entity and returns it with its version,
+// an entity without events has version 0
+func (r *Repository[T]) Load(id string) (T, uint64, error) {
+	entity := r.newEntity(id)
+	version, err := r.es.Project(entity)
+	if err != nil {
+		return entity, 0, err
+	}
+	entity.SetVersion(version)
+	return entity, version, nil
+}
+
+// LoadCtx is like Load but loading the events is bound to ctx
+func (r *Repository[T]) LoadCtx(ctx context.Context, id string) (T, uint64, error) {
+	entity := r.newEntity(id)
+	version, err := r.es.ProjectCtx(ctx, entity)
+	if err != nil {
+		return entity, 0, err
+	}
+	entity.SetVersion(version)
+	return entity, version, nil
+}
+
+// Save stores the events recorded by the entity followed by newEvents, expecting
+// the entity to be still at its version, then projects them on the entity and
+// returns its new version. Events without EntityId get the entity one. On a
+// version conflict a *backend.ErrWrongSequence is returned and nothing is stored
+func (r *Repository[T]) Save(entity T, newEvents ...*registry.Event) (uint64, error) {
+	events, expected := r.prepare(entity, newEvents)
+	if len(events) == 0 {
+		return entity.Version(), nil
+	}
+	version, err := r.es.AddEvents(events, expected)
+	if err != nil {
+		return 0, err
+	}
+	return version, r.commit(entity, events, version)
+}
+
+// SaveCtx is like Save but the write is bound to ctx
+func (r *Repository[T]) SaveCtx(ctx context.Context, entity T, newEvents ...*registry.Event) (uint64, error) {
+	events, expected := r.prepare(entity, newEvents)
+	if len(events) == 0 {
+		return entity.Version(), nil
+	}
+	version, err := r.es.AddEventsCtx(ctx, events, expected)
+	if err != nil {
+		return 0, err
+	}
+	return version, r.commit(entity, events, version)
+}
+
+// Execute loads an entity, runs command on it and saves the events it recorded.
+// If the entity changed in the meantime the whole command is run again on the
+// updated entity, following the retry policy. Returns the saved entity
+func (r *Repository[T]) Execute(id string, command func(T) error) (T, error) {
+	return r.retry(context.Background(), func() (T, error) {
+		entity, _, err := r.Load(id)
+		if err != nil {
+			return entity, err
+		}
+		err = command(entity)
+		if err != nil {
+			return entity, err
+		}
+		_, err = r.Save(entity)
+		return entity, err
+	})
+}
+
+// ExecuteCtx is like Execute but loads, saves and retries are bound to ctx
+func (r *Repository[T]) ExecuteCtx(ctx context.Context, id string, command func(T) error) (T, error) {
+	return r.retry(ctx, func() (T, error) {
+		entity, _, err := r.LoadCtx(ctx, id)
+		if err != nil {
+			return entity, err
+		}
+		err = command(entity)
+		if err != nil {
+			return entity, err
+		}
+		_, err = r.SaveCtx(ctx, entity)
+		return entity, err
+	})
+}
+
+// prepare returns the events to save and the version they expect
+func (r *Repository[T]) prepare(entity T, newEvents []*registry.Event) ([]*registry.Event, uint64) {
+	events := append(append([]*registry.Event{}, entity.Uncommitted()...), newEvents...)
+	for _, e := range events {
+		if e.EntityId == "" {
+			e.EntityId = entity.Id()
+		}
+	}
+	expected := entity.Version()
+	if expected == 0 {
+		expected = backend.NoVersion
+	}
+	return events, expected
+}
+
+// commit projects the saved events on the entity
+func (r *Repository[T]) commit(entity T, events []*registry.Event, version uint64) error {
+	entity.ClearUncommitted()
+	entity.SetVersion(version)
+	_, err := r.es.apply(entity, events)
+	return err
+}
+
+// retry runs attempt again on version conflicts, following the retry policy
+func (r *Repository[T]) retry(ctx context.Context, attempt func() (T, error)) (T, error) {
+	for i := 0; ; i++ {
+		entity, err := attempt()
+		var wrongSeq *backend.ErrWrongSequence
+		if !errors.As(err, &wrongSeq) || i >= r.policy.MaxRetries {
+			return entity, err
+		}
+		if r.policy.RetryDelay > 0 {
+			t := time.NewTimer(r.policy.RetryDelay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return entity, ctx.Err()
+			case <-t.C:
+			}
+		}
+	}
+}
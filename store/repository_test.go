@@ -0,0 +1,143 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucacox/event-sourcing/backend"
+	"github.com/lucacox/event-sourcing/registry"
+)
+
+type counterAggregate struct {
+	AggregateBase
+	ID    string
+	Count int
+}
+
+func (c *counterAggregate) Id() string {
+	return c.ID
+}
+
+func (c *counterAggregate) Project(e *registry.Event) error {
+	c.Count++
+	return nil
+}
+
+// increment is a command that fails past the given limit
+func (c *counterAggregate) increment(es *EventStore, limit int) error {
+	if c.Count >= limit {
+		return errors.New("limit reached")
+	}
+	c.Record(es.NewEvent("test-event"))
+	return nil
+}
+
+func newTestRepository() (*Repository[*counterAggregate], *EventStore) {
+	er := registry.NewEventRegistry()
+	codec := registry.NewJsonCodec(nil)
+	er.RegisterCodec(codec)
+	er.Register(registry.NewEventType("test-event", codec.Name(), func() *registry.Event {
+		return &registry.Event{
+			Type:      "test-event",
+			Timestamp: time.Now(),
+			Meta:      map[string]string{},
+		}
+	}))
+	es := NewEventStore("test-store", backend.NewInMemoryBackend(), er, 1)
+	es.Start()
+	return NewRepository(es, func(id string) *counterAggregate { return &counterAggregate{ID: id} }), es
+}
+
+func TestRepository(t *testing.T) {
+	convey.Convey("Given a repository", t, func() {
+		repo, es := newTestRepository()
+
+		convey.Convey("Loading a new entity should return version 0", func() {
+			c, version, err := repo.Load("c1")
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(0), version)
+			assert.Equal(t, "c1", c.ID)
+		})
+
+		convey.Convey("Saving a new entity should store and project its events", func() {
+			c, _, _ := repo.Load("c1")
+			c.increment(es, 10)
+			version, err := repo.Save(c, es.NewEvent("test-event"))
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(2), version)
+			assert.Equal(t, uint64(2), c.Version())
+			assert.Equal(t, 2, c.Count)
+			assert.Empty(t, c.Uncommitted())
+
+			c, version, _ = repo.Load("c1")
+			assert.Equal(t, uint64(2), version)
+			assert.Equal(t, 2, c.Count)
+		})
+
+		convey.Convey("Saving without events should be a no-op", func() {
+			c, _, _ := repo.Load("c1")
+			version, err := repo.Save(c)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, uint64(0), version)
+		})
+
+		convey.Convey("Saving a stale entity should fail", func() {
+			c1, _, _ := repo.Load("c1")
+			c2, _, _ := repo.Load("c1")
+			c1.increment(es, 10)
+			c2.increment(es, 10)
+			_, err := repo.Save(c1)
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			_, err = repo.Save(c2)
+			var wrongSeq *backend.ErrWrongSequence
+			assert.ErrorAs(t, err, &wrongSeq)
+			assert.Len(t, c2.Uncommitted(), 1, "Expected the events to stay uncommitted")
+		})
+
+		convey.Convey("Execute should run the command again on conflicts", func() {
+			attempts := 0
+			c, err := repo.Execute("c1", func(c *counterAggregate) error {
+				attempts++
+				if attempts == 1 {
+					// a concurrent writer gets there first
+					other, _, _ := repo.Load("c1")
+					other.increment(es, 10)
+					repo.Save(other)
+				}
+				return c.increment(es, 10)
+			})
+			assert.NoError(t, err, "Expected no error, but got %v", err)
+			assert.Equal(t, 2, attempts)
+			assert.Equal(t, 2, c.Count)
+			assert.Equal(t, uint64(2), c.Version())
+		})
+
+		convey.Convey("Execute should give up after MaxRetries", func() {
+			repo.SetRetryPolicy(RetryPolicy{MaxRetries: 1})
+			attempts := 0
+			_, err := repo.Execute("c1", func(c *counterAggregate) error {
+				attempts++
+				other, _, _ := repo.Load("c1")
+				other.increment(es, 10)
+				repo.Save(other)
+				return c.increment(es, 10)
+			})
+			var wrongSeq *backend.ErrWrongSequence
+			assert.ErrorAs(t, err, &wrongSeq)
+			assert.Equal(t, 2, attempts)
+		})
+
+		convey.Convey("Execute should not save when the command fails", func() {
+			_, err := repo.Execute("c1", func(c *counterAggregate) error {
+				return c.increment(es, 0)
+			})
+			assert.EqualError(t, err, "limit reached")
+			version, _ := es.Version("c1")
+			assert.Equal(t, uint64(0), version)
+		})
+	})
+}